@@ -2,6 +2,7 @@ package coinharness
 
 import (
 	"github.com/jfixby/coin"
+	"time"
 )
 
 type Network interface {
@@ -45,7 +46,13 @@ type OutPoint struct {
 	Tree  int8
 }
 
-type Hash interface{}
+// Hash is a chain-agnostic block or transaction hash. Implementations
+// must use comparable value types (e.g. chainhash.Hash, not a pointer to it),
+// so equal hashes are equal with == and can be used as map keys.
+type Hash interface {
+	// String returns the hash in the byte-reversed hex form
+	String() string
+}
 
 type TxOut struct {
 	Version  uint16
@@ -73,9 +80,25 @@ type Tx struct {
 
 type AddNodeArguments struct {
 	TargetAddr string
-	Command    interface{}
+	// Command is either the chain-specific addnode command
+	// or the AddNodeCommand
+	Command interface{}
 }
 
+// AddNodeCommand is a chain-agnostic addnode command
+type AddNodeCommand string
+
+const (
+	// AddNodeAdd adds the node as a persistent peer
+	AddNodeAdd AddNodeCommand = "add"
+
+	// AddNodeRemove removes the persistent peer
+	AddNodeRemove AddNodeCommand = "remove"
+
+	// AddNodeOneTry tries to connect the node once
+	AddNodeOneTry AddNodeCommand = "onetry"
+)
+
 type CoinbaseKey interface{}
 
 type ExtendedKey interface {
@@ -83,8 +106,15 @@ type ExtendedKey interface {
 	PrivateKey() (PrivateKey, error)
 }
 
+// BlockHeader is a chain-agnostic block header
 type BlockHeader interface {
 	Height() int64
+	Hash() Hash
+	PrevBlock() Hash
+	MerkleRoot() Hash
+	Timestamp() time.Time
+	Bits() uint32
+	Nonce() uint32
 }
 
 type PublicKey interface {
@@ -0,0 +1,294 @@
+package coinharness
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jfixby/pin"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// chainSnapshotInfoFileName is the name of the file describing the snapshot
+// chain inside the snapshot folder
+const chainSnapshotInfoFileName = "snapshot.json"
+
+// chainSnapshotExcludedFiles are not copied into snapshots,
+// they are created again by the node and the wallet on launch
+var chainSnapshotExcludedFiles = map[string]bool{
+	"stdout.log": true,
+	"rpc.cert":   true,
+	"rpc.key":    true,
+}
+
+// ChainSnapshotCache keeps node and wallet data directories of harnesses
+// deployed by the DeploySimpleChain. Snapshots are keyed by network, seed salt,
+// NumMatureOutputs, node and wallet executables and their extra arguments,
+// so later deployments with the same setup restore the snapshot instead of
+// mining the test chain again.
+type ChainSnapshotCache struct {
+	// Dir keeps the snapshots, each one in a dedicated folder
+	Dir string
+}
+
+// chainSnapshotInfo describes the chain stored in the snapshot
+type chainSnapshotInfo struct {
+	Height        int64  `json:"height"`
+	BestBlockHash string `json:"bestBlockHash"`
+}
+
+// SnapshotKey returns the name of the snapshot folder for the deployment setup,
+// the setupHash tells apart executables and arguments of the deployment
+func (cache *ChainSnapshotCache) SnapshotKey(net Network, seedSalt uint32, numMatureOutputs int64, setupHash string) string {
+	return fmt.Sprintf("%v-seed%v-mature%v-%v", networkName(net), seedSalt, numMatureOutputs, setupHash)
+}
+
+// deploymentHash fingerprints the node and wallet executables
+// and the extra arguments the harness is launched with
+func deploymentHash(testSetup *ChainWithMatureOutputsSpawner, h *Harness) (string, error) {
+	hash := sha256.New()
+	for _, component := range []interface{}{h.Node, h.Wallet} {
+		fmt.Fprintf(hash, "%T\n", component)
+		if runner, ok := component.(ExecutableRunner); ok {
+			if err := hashExecutable(hash, runner.Executable()); err != nil {
+				return "", err
+			}
+		}
+	}
+	hashArguments(hash, testSetup.NodeStartExtraArguments)
+	hashArguments(hash, testSetup.WalletStartExtraArguments)
+	fmt.Fprintf(hash, "createtemp=%v\n", testSetup.CreateTempWallet)
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+// hashExecutable writes content of the executable into the w,
+// the executable is looked up in the PATH when it is not a path
+func hashExecutable(w io.Writer, executable string) error {
+	path, err := exec.LookPath(executable)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// hashArguments writes the arguments into the w sorted by name
+func hashArguments(w io.Writer, args map[string]interface{}) {
+	names := make([]string, 0, len(args))
+	for name := range args {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "%v=%v\n", name, args[name])
+	}
+	fmt.Fprintln(w)
+}
+
+// Has returns true when the cache has the snapshot for the key
+func (cache *ChainSnapshotCache) Has(key string) bool {
+	_, err := os.Stat(filepath.Join(cache.Dir, key, chainSnapshotInfoFileName))
+	return err == nil
+}
+
+// save copies the harness WorkingDir into the snapshot for the key.
+// The harness node and wallet must be stopped. The snapshot is not saved
+// when another process is saving the same snapshot.
+func (cache *ChainSnapshotCache) save(key string, h *Harness, info *chainSnapshotInfo) error {
+	snapshotDir := filepath.Join(cache.Dir, key)
+	if err := os.MkdirAll(cache.Dir, 0700); err != nil {
+		return err
+	}
+
+	// The lock is held across the check, the copy and the rename,
+	// so concurrent test binaries never replace a complete snapshot
+	lockFile := filepath.Join(cache.Dir, key+".lock")
+	if !acquireLockFile(lockFile) {
+		return nil
+	}
+	defer os.Remove(lockFile)
+	if cache.Has(key) {
+		return nil
+	}
+
+	// Copy into a temp folder first, so concurrent test binaries
+	// never see a partially written snapshot
+	tmpDir, err := ioutil.TempDir(cache.Dir, key+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := copyDir(h.WorkingDir, tmpDir); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(tmpDir, chainSnapshotInfoFileName), data, 0600)
+	if err != nil {
+		return err
+	}
+
+	// Only an incomplete snapshot left by a crashed process can be here
+	os.RemoveAll(snapshotDir)
+	return os.Rename(tmpDir, snapshotDir)
+}
+
+// restore copies the snapshot for the key into the harness WorkingDir
+func (cache *ChainSnapshotCache) restore(key string, h *Harness) (*chainSnapshotInfo, error) {
+	snapshotDir := filepath.Join(cache.Dir, key)
+	data, err := ioutil.ReadFile(filepath.Join(snapshotDir, chainSnapshotInfoFileName))
+	if err != nil {
+		return nil, err
+	}
+	info := &chainSnapshotInfo{}
+	if err := json.Unmarshal(data, info); err != nil {
+		return nil, fmt.Errorf("unable to read chain snapshot %v: %v", snapshotDir, err)
+	}
+	if err := copyDir(snapshotDir, h.WorkingDir); err != nil {
+		return nil, err
+	}
+	os.Remove(filepath.Join(h.WorkingDir, chainSnapshotInfoFileName))
+	return info, nil
+}
+
+// restoreSimpleChain deploys the harness from the snapshot.
+// Returns false when the cache has no valid snapshot for the harness.
+func restoreSimpleChain(testSetup *ChainWithMatureOutputsSpawner, h *Harness, key string) bool {
+	cache := testSetup.SnapshotCache
+	if !cache.Has(key) {
+		return false
+	}
+	info, err := cache.restore(key, h)
+	if err != nil {
+		os.RemoveAll(h.WorkingDir)
+		return false
+	}
+
+	args := relaunchArguments(testSetup)
+	launchHarnessSequence(h, args)
+
+	hash, height, err := h.NodeRPCClient().GetBestBlock()
+	pin.CheckTestSetupMalfunction(err)
+	if height != info.Height || hashToString(hash) != info.BestBlockHash {
+		// The snapshot is stale, deploy the harness from scratch
+		shutdownHarnessSequence(h)
+		os.RemoveAll(h.WorkingDir)
+		return false
+	}
+
+	// The mining address is not stored in the snapshot,
+	// restart the node with a new one
+	address, err := h.Wallet.NewAddress(DefaultAccountName)
+	pin.CheckTestSetupMalfunction(err)
+	h.MiningAddress = address
+	shutdownHarnessSequence(h)
+	launchHarnessSequence(h, args)
+
+	catchUpWallet(h, height)
+	return true
+}
+
+// saveSimpleChain stores the deployed harness into the snapshot cache.
+// The harness is restarted after the data directories are copied.
+func saveSimpleChain(testSetup *ChainWithMatureOutputsSpawner, h *Harness, key string) {
+	hash, height, err := h.NodeRPCClient().GetBestBlock()
+	pin.CheckTestSetupMalfunction(err)
+	info := &chainSnapshotInfo{
+		Height:        height,
+		BestBlockHash: hashToString(hash),
+	}
+
+	shutdownHarnessSequence(h)
+	// The snapshot only speeds up later deployments,
+	// the harness is usable when it is not saved
+	testSetup.SnapshotCache.save(key, h, info)
+
+	args := relaunchArguments(testSetup)
+	launchHarnessSequence(h, args)
+
+	catchUpWallet(h, height)
+}
+
+// catchUpWallet syncs the relaunched harness wallet to the height.
+// A Rescanner wallet which state is not kept in the WorkingDir starts
+// behind the restored chain, it rescans the missing blocks first.
+func catchUpWallet(h *Harness, height int64) {
+	if wallet, ok := h.Wallet.(Rescanner); ok {
+		if synced := h.Wallet.SyncedHeight(); synced < height {
+			err := wallet.Rescan(synced+1, height)
+			pin.CheckTestSetupMalfunction(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), WalletSyncTimeout)
+	_, err := h.Wallet.Sync(ctx, height, printSyncProgress)
+	cancel()
+	pin.CheckTestSetupMalfunction(err)
+}
+
+// networkName returns the Name of the network params,
+// or the params type name when the params have no Name field
+func networkName(net Network) string {
+	params := net.Params()
+	v := reflect.Indirect(reflect.ValueOf(params))
+	if v.Kind() == reflect.Struct {
+		name := v.FieldByName("Name")
+		if name.Kind() == reflect.String && name.String() != "" {
+			return name.String()
+		}
+	}
+	return strings.Trim(fmt.Sprintf("%T", params), "*")
+}
+
+// copyDir copies files of the src folder tree into the dst folder
+func copyDir(src string, dst string) error {
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0700)
+		}
+		if chainSnapshotExcludedFiles[info.Name()] {
+			return nil
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
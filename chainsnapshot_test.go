@@ -0,0 +1,85 @@
+package coinharness
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// executableNode runs the executable file
+type executableNode struct {
+	Node
+	executable string
+}
+
+func (node *executableNode) Executable() string {
+	return node.executable
+}
+
+func TestDeploymentHashTracksExecutablesAndArguments(t *testing.T) {
+	executable := filepath.Join(t.TempDir(), "node")
+	writeExecutable := func(content string) {
+		if err := ioutil.WriteFile(executable, []byte(content), 0700); err != nil {
+			t.Fatalf("unable to write executable: %v", err)
+		}
+	}
+	testSetup := &ChainWithMatureOutputsSpawner{}
+	h := &Harness{
+		Node:   &executableNode{executable: executable},
+		Wallet: &disposableWallet{},
+	}
+	hashOf := func() string {
+		hash, err := deploymentHash(testSetup, h)
+		if err != nil {
+			t.Fatalf("unable to hash deployment: %v", err)
+		}
+		return hash
+	}
+
+	writeExecutable("v1")
+	v1 := hashOf()
+	if hashOf() != v1 {
+		t.Fatalf("hash of the same deployment has changed")
+	}
+
+	writeExecutable("v2")
+	v2 := hashOf()
+	if v2 == v1 {
+		t.Fatalf("hash has not changed with the node executable")
+	}
+
+	testSetup.NodeStartExtraArguments = map[string]interface{}{"txindex": true}
+	if hashOf() == v2 {
+		t.Fatalf("hash has not changed with the node arguments")
+	}
+
+	h.Node = &executableNode{executable: filepath.Join(t.TempDir(), "missing")}
+	if _, err := deploymentHash(testSetup, h); err == nil {
+		t.Fatalf("missing executable is hashed")
+	}
+}
+
+func TestCatchUpWalletRescansRestoredChain(t *testing.T) {
+	// The wallet state is not kept in the WorkingDir,
+	// it starts at the genesis of the restored chain
+	node := &fakeChainRPCClient{
+		blocks: newTestChain(10, map[int64]string{5: "root/0"}),
+	}
+	wallet := newTestStateWallet("")
+	wallet.RPCClientFactory = &fakeChainRPCClientFactory{node: node}
+	if err := wallet.Start(&TestWalletStartArgs{}); err != nil {
+		t.Fatalf("unable to start wallet: %v", err)
+	}
+	defer wallet.Stop()
+
+	catchUpWallet(&Harness{Wallet: wallet}, 10)
+
+	if height := wallet.SyncedHeight(); height != 10 {
+		t.Fatalf("wallet is at height %v, expected 10", height)
+	}
+	wallet.RLock()
+	defer wallet.RUnlock()
+	if len(wallet.Utxos) != 1 {
+		t.Fatalf("wallet has %v outputs, expected 1", len(wallet.Utxos))
+	}
+}
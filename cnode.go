@@ -21,6 +21,9 @@ type NewConsoleNodeArgs struct {
 	NodeRPCHost                string
 	P2PPort                    int
 	NodeRPCPort                int
+
+	// ReadinessProbe, WaitForFileProbe when not set
+	ReadinessProbe ReadinessProbe
 }
 
 func NewConsoleNode(args *NewConsoleNodeArgs) *ConsoleNode {
@@ -39,6 +42,8 @@ func NewConsoleNode(args *NewConsoleNodeArgs) *ConsoleNode {
 		NodeExecutablePathProvider: args.NodeExecutablePathProvider,
 		network:                    args.ActiveNet,
 		ConsoleCommandCook:         args.ConsoleCommandCook,
+		ReadinessProbe:             args.ReadinessProbe,
+		clientFac:                  args.ClientFac,
 	}
 	return node
 }
@@ -59,13 +64,19 @@ type ConsoleNode struct {
 	appDir     string
 	endpoint   string
 
-	externalProcess commandline.ExternalProcess
+	externalProcess ConsoleProcess
 
 	rPCClient *RPCConnection
 
 	network Network
 
 	ConsoleCommandCook ConsoleCommandNodeCook
+
+	// ReadinessProbe decides when the launched node is ready for
+	// incoming RPC calls, WaitForFileProbe when not set
+	ReadinessProbe ReadinessProbe
+
+	clientFac RPCClientFactory
 }
 
 type ConsoleCommandNodeParams struct {
@@ -125,6 +136,27 @@ func (node *ConsoleNode) KeyFile() string {
 	return filepath.Join(node.appDir, "rpc.key")
 }
 
+// LogPath returns file path of the node process stdout and stderr log
+func (node *ConsoleNode) LogPath() string {
+	return filepath.Join(node.appDir, "stdout.log")
+}
+
+// TailLog returns the last n lines of the node process log
+func (node *ConsoleNode) TailLog(n int) ([]string, error) {
+	return node.externalProcess.TailLog(n)
+}
+
+// Executable returns the node executable. Implements ExecutableRunner.
+func (node *ConsoleNode) Executable() string {
+	return node.NodeExecutablePathProvider.Executable()
+}
+
+// SetOnProcessExit registers the callback invoked when the node process
+// exits without being stopped. Implements ProcessWatcher.
+func (node *ConsoleNode) SetOnProcessExit(onExit func(exit *ProcessExitError)) {
+	node.externalProcess.SetOnExit(onExit)
+}
+
 // Network returns current network of the node
 func (node *ConsoleNode) Network() Network {
 	return node.network
@@ -137,15 +169,16 @@ func (node *ConsoleNode) IsRunning() bool {
 
 // Start node process. Deploys working dir, launches node using command-line,
 // connects RPC client to the node.
-func (node *ConsoleNode) Start(args *StartNodeArgs) {
+func (node *ConsoleNode) Start(args *StartNodeArgs) error {
 	if node.IsRunning() {
-		pin.ReportTestSetupMalfunction(fmt.Errorf("ConsoleNode is already running"))
+		return ErrAlreadyRunning
 	}
 	fmt.Println("Start node process...")
 	pin.MakeDirs(node.appDir)
 
 	exec := node.NodeExecutablePathProvider.Executable()
 	node.externalProcess.CommandName = exec
+	node.externalProcess.LogFile = node.LogPath()
 
 	consoleCommandParams := &ConsoleCommandNodeParams{
 		ExtraArguments: args.ExtraArguments,
@@ -166,42 +199,66 @@ func (node *ConsoleNode) Start(args *StartNodeArgs) {
 	node.externalProcess.Arguments = commandline.ArgumentsToStringArray(
 		node.ConsoleCommandCook.CookArguments(consoleCommandParams),
 	)
-	node.externalProcess.Launch(args.DebugOutput)
-	// Node RPC instance will create a cert file when it is ready for incoming calls
-	pin.WaitForFile(node.CertFile(), 7)
+	if err := node.externalProcess.Launch(args.DebugOutput); err != nil {
+		return err
+	}
+	target := &ProbeTarget{
+		CertFile:      node.CertFile(),
+		LogFile:       node.LogPath(),
+		RPCConfig:     node.RPCConnectionConfig(),
+		ClientFactory: node.clientFac,
+		Process:       &node.externalProcess,
+	}
+	if err := waitReady(node.ReadinessProbe, target, args.MaxSecondsToWaitOnLaunch); err != nil {
+		node.externalProcess.Stop()
+		return err
+	}
 
 	fmt.Println("Connect to node RPC...")
 	cfg := node.RPCConnectionConfig()
-	node.rPCClient.Connect(cfg, nil)
+	if err := node.rPCClient.Connect(cfg, nil); err != nil {
+		node.externalProcess.Stop()
+		return err
+	}
+	node.rPCClient.rpcClient = newProcessAwareRPCClient(node.rPCClient.rpcClient, &node.externalProcess)
 	fmt.Println("node RPC client connected.")
+	return nil
 }
 
 // Stop interrupts the running node process.
 // Disconnects RPC client from the node, removes cert-files produced by the node,
-// stops node process.
-func (node *ConsoleNode) Stop() {
-	if !node.IsRunning() {
-		pin.ReportTestSetupMalfunction(fmt.Errorf("node is not running"))
+// stops node process. A node process exited unexpectedly is cleaned up
+// the same way, so the node can be started again.
+func (node *ConsoleNode) Stop() error {
+	crashed := node.externalProcess.UnexpectedExit() != nil
+	if !node.IsRunning() && !crashed {
+		return ErrNotRunning
 	}
 
+	// The RPC client stays connected after the process has crashed
 	if node.rPCClient.IsConnected() {
 		fmt.Println("Disconnect from node RPC...")
 		node.rPCClient.Disconnect()
 	}
 
-	fmt.Println("Stop node process...")
-	err := node.externalProcess.Stop()
-	pin.CheckTestSetupMalfunction(err)
+	if node.IsRunning() {
+		fmt.Println("Stop node process...")
+		err := node.externalProcess.Stop()
+		if err != nil {
+			return err
+		}
+	}
 
 	// Delete files, RPC servers will recreate them on the next launch sequence
 	pin.DeleteFile(node.CertFile())
 	pin.DeleteFile(node.KeyFile())
+	return nil
 }
 
-// Dispose simply stops the node process if running
+// Dispose simply stops the node process if running or crashed
 func (node *ConsoleNode) Dispose() error {
-	if node.IsRunning() {
-		node.Stop()
+	if node.IsRunning() || node.externalProcess.UnexpectedExit() != nil {
+		return node.Stop()
 	}
 	return nil
 }
@@ -0,0 +1,143 @@
+package coinharness
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// fakeRPCClient answers the calls made by the RPCConnection
+type fakeRPCClient struct {
+	RPCClient
+}
+
+func (c *fakeRPCClient) NotifyBlocks() error {
+	return nil
+}
+
+func (c *fakeRPCClient) Disconnect() {
+}
+
+func (c *fakeRPCClient) Shutdown() {
+}
+
+type fakeRPCClientFactory struct {
+}
+
+func (f *fakeRPCClientFactory) NewRPCConnection(config RPCConnectionConfig, handlers *NotificationHandlers) (RPCClient, error) {
+	return &fakeRPCClient{}, nil
+}
+
+// readyProbe reports the process is ready right after launch
+type readyProbe struct {
+}
+
+func (probe *readyProbe) WaitReady(ctx context.Context, target *ProbeTarget) error {
+	return nil
+}
+
+type fakeNodeCook struct {
+}
+
+func (cook *fakeNodeCook) CookArguments(par *ConsoleCommandNodeParams) map[string]interface{} {
+	return map[string]interface{}{}
+}
+
+type scriptPathProvider struct {
+	path string
+}
+
+func (p *scriptPathProvider) Executable() string {
+	return p.path
+}
+
+// newSleepingNode returns a ConsoleNode running a script
+// which ignores its arguments and sleeps
+func newSleepingNode(t *testing.T) *ConsoleNode {
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a shell script executable")
+	}
+	dir, err := ioutil.TempDir("", "cnode-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	script := filepath.Join(dir, "node.sh")
+	err = ioutil.WriteFile(script, []byte("#!/bin/sh\nexec sleep 60\n"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewConsoleNode(&NewConsoleNodeArgs{
+		ClientFac:                  &fakeRPCClientFactory{},
+		ConsoleCommandCook:         &fakeNodeCook{},
+		NodeExecutablePathProvider: &scriptPathProvider{path: script},
+		AppDir:                     filepath.Join(dir, "node"),
+		ActiveNet:                  &fakeNetwork{},
+		P2PHost:                    "127.0.0.1",
+		NodeRPCHost:                "127.0.0.1",
+		ReadinessProbe:             &readyProbe{},
+	})
+}
+
+type fakeNetwork struct {
+}
+
+func (net *fakeNetwork) CoinbaseMaturity() int64 {
+	return 16
+}
+
+func (net *fakeNetwork) Params() interface{} {
+	return nil
+}
+
+func TestConsoleNodeRestartAfterCrash(t *testing.T) {
+	node := newSleepingNode(t)
+	defer node.Dispose()
+
+	if err := node.Start(&StartNodeArgs{}); err != nil {
+		t.Fatalf("unable to start node: %v", err)
+	}
+
+	// Kill the process behind the node's back
+	node.externalProcess.mtx.Lock()
+	process := node.externalProcess.cmd.Process
+	node.externalProcess.mtx.Unlock()
+	if err := process.Kill(); err != nil {
+		t.Fatalf("unable to kill node process: %v", err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for node.externalProcess.UnexpectedExit() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("crash is not detected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if node.IsRunning() {
+		t.Fatal("crashed node is reported running")
+	}
+	if !node.RPCClient().IsConnected() {
+		t.Fatal("RPC client is expected to stay connected until Stop")
+	}
+
+	if err := node.Stop(); err != nil {
+		t.Fatalf("unable to stop crashed node: %v", err)
+	}
+	if node.RPCClient().IsConnected() {
+		t.Fatal("RPC client is still connected after Stop")
+	}
+
+	if err := node.Start(&StartNodeArgs{}); err != nil {
+		t.Fatalf("unable to restart node: %v", err)
+	}
+	if !node.IsRunning() {
+		t.Fatal("restarted node is not running")
+	}
+	if err := node.Stop(); err != nil {
+		t.Fatalf("unable to stop node: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+package coinharness
+
+import (
+	"fmt"
+	"github.com/jfixby/coin"
+	"math/rand"
+	"sort"
+)
+
+// CoinSelector picks the outputs used to fund a transaction
+// produced by the CreateTransaction
+type CoinSelector interface {
+	// SelectCoins picks outputs from the spendable candidates.
+	// amountNeeded reports the amount that numInputs inputs must cover:
+	// the value of the transaction outputs plus the fee.
+	SelectCoins(candidates []*Unspent, amountNeeded func(numInputs int) coin.Amount) (*CoinSelection, error)
+}
+
+// CoinSelection is a result of the CoinSelector.SelectCoins call
+type CoinSelection struct {
+	// Inputs in the order the transaction is spending them
+	Inputs []*Unspent
+
+	// NoChange leaves the excess of the Inputs value to the miners
+	// instead of adding a change output
+	NoChange bool
+}
+
+// FirstFitCoinSelector walks candidates in the given order
+// until the needed amount is collected. This is the default
+// CreateTransaction behaviour.
+type FirstFitCoinSelector struct {
+}
+
+// SelectCoins implements CoinSelector
+func (s *FirstFitCoinSelector) SelectCoins(candidates []*Unspent, amountNeeded func(numInputs int) coin.Amount) (*CoinSelection, error) {
+	return firstFit(candidates, amountNeeded)
+}
+
+// LargestFirstCoinSelector spends the largest outputs first,
+// minimizing the number of transaction inputs
+type LargestFirstCoinSelector struct {
+}
+
+// SelectCoins implements CoinSelector
+func (s *LargestFirstCoinSelector) SelectCoins(candidates []*Unspent, amountNeeded func(numInputs int) coin.Amount) (*CoinSelection, error) {
+	sorted := sortedByAmount(candidates)
+	for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	}
+	return firstFit(sorted, amountNeeded)
+}
+
+// SmallestFirstCoinSelector spends the smallest outputs first,
+// useful to produce many-input transactions and sweep dust
+type SmallestFirstCoinSelector struct {
+}
+
+// SelectCoins implements CoinSelector
+func (s *SmallestFirstCoinSelector) SelectCoins(candidates []*Unspent, amountNeeded func(numInputs int) coin.Amount) (*CoinSelection, error) {
+	return firstFit(sortedByAmount(candidates), amountNeeded)
+}
+
+// RandomCoinSelector spends outputs in a pseudo-random order.
+// The same Seed and candidates produce the same selection.
+type RandomCoinSelector struct {
+	Seed int64
+}
+
+// SelectCoins implements CoinSelector
+func (s *RandomCoinSelector) SelectCoins(candidates []*Unspent, amountNeeded func(numInputs int) coin.Amount) (*CoinSelection, error) {
+	// sort first to not depend on the order of the candidates
+	shuffled := sortedByAmount(candidates)
+	r := rand.New(rand.NewSource(s.Seed))
+	r.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	return firstFit(shuffled, amountNeeded)
+}
+
+// ExactCoinSelector spends all of the listed outputs and nothing else
+type ExactCoinSelector struct {
+	Outputs []OutPoint
+}
+
+// SelectCoins implements CoinSelector
+func (s *ExactCoinSelector) SelectCoins(candidates []*Unspent, amountNeeded func(numInputs int) coin.Amount) (*CoinSelection, error) {
+	selected := []*Unspent{}
+	for _, op := range s.Outputs {
+		txID := hashToString(op.Hash)
+		var found *Unspent
+		for _, c := range candidates {
+			if c.TxID == txID && c.Vout == op.Index {
+				found = c
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("output %v:%v is not spendable", txID, op.Index)
+		}
+		selected = append(selected, found)
+	}
+
+	if totalAmount(selected).AtomsValue < amountNeeded(len(selected)).AtomsValue {
+		return nil, fmt.Errorf("not enough funds for coin selection")
+	}
+	return &CoinSelection{Inputs: selected}, nil
+}
+
+// BranchAndBoundCoinSelector searches for a set of outputs matching the
+// needed amount, so the transaction requires no change output.
+// Any excess up to MaxWaste is paid to the miners.
+type BranchAndBoundCoinSelector struct {
+	MaxWaste coin.Amount
+
+	// MaxTries limits the search, 100000 when not set
+	MaxTries int
+}
+
+// SelectCoins implements CoinSelector
+func (s *BranchAndBoundCoinSelector) SelectCoins(candidates []*Unspent, amountNeeded func(numInputs int) coin.Amount) (*CoinSelection, error) {
+	maxTries := s.MaxTries
+	if maxTries == 0 {
+		maxTries = 100000
+	}
+
+	// Walk from the largest output so the search
+	// overshoots early and prunes more branches
+	sorted := sortedByAmount(candidates)
+	for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	}
+
+	// remaining[i] is the total value of sorted[i:]
+	remaining := make([]int64, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + sorted[i].Amount.AtomsValue
+	}
+
+	tries := 0
+	picked := []*Unspent{}
+	var search func(index int, sum int64) bool
+	search = func(index int, sum int64) bool {
+		tries++
+		if tries > maxTries {
+			return false
+		}
+		if len(picked) > 0 {
+			need := amountNeeded(len(picked)).AtomsValue
+			if sum >= need && sum <= need+s.MaxWaste.AtomsValue {
+				return true
+			}
+		}
+		if index == len(sorted) {
+			return false
+		}
+		// Even with all of the remaining outputs
+		// the needed amount is out of reach
+		if sum+remaining[index] < amountNeeded(len(picked)+1).AtomsValue {
+			return false
+		}
+
+		// include sorted[index]
+		next := sorted[index]
+		picked = append(picked, next)
+		nextSum := sum + next.Amount.AtomsValue
+		if nextSum <= amountNeeded(len(picked)).AtomsValue+s.MaxWaste.AtomsValue {
+			if search(index+1, nextSum) {
+				return true
+			}
+		}
+		picked = picked[:len(picked)-1]
+
+		// exclude sorted[index]
+		return search(index+1, sum)
+	}
+
+	if !search(0, 0) {
+		return nil, fmt.Errorf("no exact match found for coin selection")
+	}
+	return &CoinSelection{Inputs: picked, NoChange: true}, nil
+}
+
+// firstFit takes candidates in the given order until
+// the needed amount is collected
+func firstFit(candidates []*Unspent, amountNeeded func(numInputs int) coin.Amount) (*CoinSelection, error) {
+	selected := []*Unspent{}
+	amtSelected := coin.Amount{AtomsValue: 0}
+	for _, output := range candidates {
+		selected = append(selected, output)
+		amtSelected.AtomsValue += output.Amount.AtomsValue
+		if amtSelected.AtomsValue >= amountNeeded(len(selected)).AtomsValue {
+			return &CoinSelection{Inputs: selected}, nil
+		}
+	}
+	return nil, fmt.Errorf("not enough funds for coin selection")
+}
+
+// sortedByAmount returns a copy of the outputs sorted by ascending amount
+func sortedByAmount(outputs []*Unspent) []*Unspent {
+	sorted := make([]*Unspent, len(outputs))
+	copy(sorted, outputs)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Amount.AtomsValue != sorted[j].Amount.AtomsValue {
+			return sorted[i].Amount.AtomsValue < sorted[j].Amount.AtomsValue
+		}
+		if sorted[i].TxID != sorted[j].TxID {
+			return sorted[i].TxID < sorted[j].TxID
+		}
+		return sorted[i].Vout < sorted[j].Vout
+	})
+	return sorted
+}
+
+// totalAmount sums up value of the outputs
+func totalAmount(outputs []*Unspent) coin.Amount {
+	total := coin.Amount{AtomsValue: 0}
+	for _, output := range outputs {
+		total.AtomsValue += output.Amount.AtomsValue
+	}
+	return total
+}
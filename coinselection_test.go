@@ -0,0 +1,173 @@
+package coinharness
+
+import (
+	"fmt"
+	"github.com/jfixby/coin"
+	"reflect"
+	"testing"
+)
+
+func newTestCandidates(amounts ...int64) []*Unspent {
+	candidates := []*Unspent{}
+	for i, amount := range amounts {
+		candidates = append(candidates, &Unspent{
+			TxID:   fmt.Sprintf("tx-%v", i),
+			Amount: coin.Amount{AtomsValue: amount},
+		})
+	}
+	return candidates
+}
+
+func TestCoinSelectors(t *testing.T) {
+	// Each input adds 100 atoms of fee
+	const feePerInput = 100
+	candidates := newTestCandidates(1000, 2000, 5000, 10000)
+	outPoint := func(txID string) OutPoint {
+		return OutPoint{Hash: testHash(txID)}
+	}
+
+	tests := []struct {
+		name         string
+		selector     CoinSelector
+		target       int64
+		wantInputs   []int64
+		wantNoChange bool
+		wantErr      bool
+	}{
+		{
+			name:       "first fit exact match",
+			selector:   &FirstFitCoinSelector{},
+			target:     2800,
+			wantInputs: []int64{1000, 2000},
+		},
+		{
+			name:       "first fit with change",
+			selector:   &FirstFitCoinSelector{},
+			target:     2900,
+			wantInputs: []int64{1000, 2000, 5000},
+		},
+		{
+			name:     "first fit insufficient funds",
+			selector: &FirstFitCoinSelector{},
+			target:   17700,
+			wantErr:  true,
+		},
+		{
+			name:       "largest first",
+			selector:   &LargestFirstCoinSelector{},
+			target:     2800,
+			wantInputs: []int64{10000},
+		},
+		{
+			name:       "smallest first",
+			selector:   &SmallestFirstCoinSelector{},
+			target:     6000,
+			wantInputs: []int64{1000, 2000, 5000},
+		},
+		{
+			name:     "random insufficient funds",
+			selector: &RandomCoinSelector{Seed: 1},
+			target:   20000,
+			wantErr:  true,
+		},
+		{
+			name:       "exact outputs",
+			selector:   &ExactCoinSelector{Outputs: []OutPoint{outPoint("tx-2")}},
+			target:     4900,
+			wantInputs: []int64{5000},
+		},
+		{
+			name:     "exact outputs insufficient funds",
+			selector: &ExactCoinSelector{Outputs: []OutPoint{outPoint("tx-2")}},
+			target:   4901,
+			wantErr:  true,
+		},
+		{
+			name:     "exact outputs unknown output",
+			selector: &ExactCoinSelector{Outputs: []OutPoint{outPoint("tx-9")}},
+			target:   100,
+			wantErr:  true,
+		},
+		{
+			name:         "branch and bound exact match",
+			selector:     &BranchAndBoundCoinSelector{},
+			target:       6800,
+			wantInputs:   []int64{5000, 2000},
+			wantNoChange: true,
+		},
+		{
+			name:         "branch and bound excess within the change threshold",
+			selector:     &BranchAndBoundCoinSelector{MaxWaste: coin.Amount{AtomsValue: 50}},
+			target:       6750,
+			wantInputs:   []int64{5000, 2000},
+			wantNoChange: true,
+		},
+		{
+			name:     "branch and bound excess above the change threshold",
+			selector: &BranchAndBoundCoinSelector{MaxWaste: coin.Amount{AtomsValue: 49}},
+			target:   6750,
+			wantErr:  true,
+		},
+		{
+			name:     "branch and bound insufficient funds",
+			selector: &BranchAndBoundCoinSelector{MaxWaste: coin.Amount{AtomsValue: 1000}},
+			target:   20000,
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			amountNeeded := func(numInputs int) coin.Amount {
+				return coin.Amount{AtomsValue: test.target + int64(numInputs)*feePerInput}
+			}
+			selection, err := test.selector.SelectCoins(candidates, amountNeeded)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, selected %v", selection.Inputs)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			inputs := []int64{}
+			for _, input := range selection.Inputs {
+				inputs = append(inputs, input.Amount.AtomsValue)
+			}
+			if !reflect.DeepEqual(inputs, test.wantInputs) {
+				t.Fatalf("selected %v, expected %v", inputs, test.wantInputs)
+			}
+			if selection.NoChange != test.wantNoChange {
+				t.Fatalf("NoChange is %v, expected %v", selection.NoChange, test.wantNoChange)
+			}
+		})
+	}
+}
+
+func TestRandomCoinSelectorIsDeterministic(t *testing.T) {
+	candidates := newTestCandidates(1000, 2000, 3000, 4000, 5000, 6000)
+	amountNeeded := func(numInputs int) coin.Amount {
+		return coin.Amount{AtomsValue: 7000}
+	}
+	first, err := (&RandomCoinSelector{Seed: 7}).SelectCoins(candidates, amountNeeded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The order of the candidates does not matter
+	reversed := []*Unspent{}
+	for i := len(candidates) - 1; i >= 0; i-- {
+		reversed = append(reversed, candidates[i])
+	}
+	second, err := (&RandomCoinSelector{Seed: 7}).SelectCoins(reversed, amountNeeded)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(first.Inputs, second.Inputs) {
+		t.Fatalf("selections differ: %v and %v", first.Inputs, second.Inputs)
+	}
+	if totalAmount(first.Inputs).AtomsValue < 7000 {
+		t.Fatalf("selected %v, not enough funds", totalAmount(first.Inputs))
+	}
+}
@@ -1,6 +1,7 @@
 package coinharness
 
 import (
+	"context"
 	"fmt"
 	"github.com/jfixby/coin"
 	"github.com/jfixby/pin"
@@ -8,6 +9,7 @@ import (
 	"net"
 	"path/filepath"
 	"strconv"
+	"time"
 )
 
 type NewConsoleWalletArgs struct {
@@ -27,6 +29,9 @@ type NewConsoleWalletArgs struct {
 	WalletRPCPort int
 	WalletUser    string
 	WalletPass    string
+
+	// ReadinessProbe, WaitForFileProbe when not set
+	ReadinessProbe ReadinessProbe
 }
 
 func NewConsoleWallet(args *NewConsoleWalletArgs) *ConsoleWallet {
@@ -56,6 +61,8 @@ func NewConsoleWallet(args *NewConsoleWalletArgs) *ConsoleWallet {
 		WalletExecutablePathProvider: args.WalletExecutablePathProvider,
 		network:                      args.ActiveNet,
 		ConsoleCommandCook:           args.ConsoleCommandCook,
+		ReadinessProbe:               args.ReadinessProbe,
+		clientFac:                    args.ClientFac,
 	}
 	return Wallet
 }
@@ -78,13 +85,19 @@ type ConsoleWallet struct {
 	debugLevel        string
 	endpoint          string
 
-	externalProcess commandline.ExternalProcess
+	externalProcess ConsoleProcess
 
 	rPCClient *RPCConnection
 
 	network Network
 
 	ConsoleCommandCook ConsoleCommandWalletCook
+
+	// ReadinessProbe decides when the launched wallet is ready for
+	// incoming RPC calls, WaitForFileProbe when not set
+	ReadinessProbe ReadinessProbe
+
+	clientFac RPCClientFactory
 }
 
 type ConsoleCommandWalletParams struct {
@@ -135,6 +148,27 @@ func (wallet *ConsoleWallet) KeyFile() string {
 	return filepath.Join(wallet.appDir, "rpc.key")
 }
 
+// LogPath returns file path of the Wallet process stdout and stderr log
+func (wallet *ConsoleWallet) LogPath() string {
+	return filepath.Join(wallet.appDir, "stdout.log")
+}
+
+// TailLog returns the last n lines of the Wallet process log
+func (wallet *ConsoleWallet) TailLog(n int) ([]string, error) {
+	return wallet.externalProcess.TailLog(n)
+}
+
+// Executable returns the Wallet executable. Implements ExecutableRunner.
+func (wallet *ConsoleWallet) Executable() string {
+	return wallet.WalletExecutablePathProvider.Executable()
+}
+
+// SetOnProcessExit registers the callback invoked when the Wallet process
+// exits without being stopped. Implements ProcessWatcher.
+func (wallet *ConsoleWallet) SetOnProcessExit(onExit func(exit *ProcessExitError)) {
+	wallet.externalProcess.SetOnExit(onExit)
+}
+
 // Network returns current network of the Wallet
 func (wallet *ConsoleWallet) Network() Network {
 	return wallet.network
@@ -149,13 +183,14 @@ func (wallet *ConsoleWallet) IsRunning() bool {
 // connects RPC client to the wallet.
 func (wallet *ConsoleWallet) Start(args *TestWalletStartArgs) error {
 	if wallet.IsRunning() {
-		pin.ReportTestSetupMalfunction(fmt.Errorf("ConsoleWallet is already running"))
+		return ErrAlreadyRunning
 	}
 	fmt.Println("Start Wallet process...")
 	pin.MakeDirs(wallet.appDir)
 
 	exec := wallet.WalletExecutablePathProvider.Executable()
 	wallet.externalProcess.CommandName = exec
+	wallet.externalProcess.LogFile = wallet.LogPath()
 
 	consoleCommandParams := &ConsoleCommandWalletParams{
 		ExtraArguments: args.ExtraArguments,
@@ -176,13 +211,28 @@ func (wallet *ConsoleWallet) Start(args *TestWalletStartArgs) error {
 	wallet.externalProcess.Arguments = commandline.ArgumentsToStringArray(
 		wallet.ConsoleCommandCook.CookArguments(consoleCommandParams),
 	)
-	wallet.externalProcess.Launch(args.DebugOutput)
-	// Wallet RPC instance will create a cert file when it is ready for incoming calls
-	pin.WaitForFile(wallet.CertFile(), 15)
+	if err := wallet.externalProcess.Launch(args.DebugOutput); err != nil {
+		return err
+	}
+	target := &ProbeTarget{
+		CertFile:      wallet.CertFile(),
+		LogFile:       wallet.LogPath(),
+		RPCConfig:     wallet.RPCConnectionConfig(),
+		ClientFactory: wallet.clientFac,
+		Process:       &wallet.externalProcess,
+	}
+	if err := waitReady(wallet.ReadinessProbe, target, args.MaxSecondsToWaitOnLaunch); err != nil {
+		wallet.externalProcess.Stop()
+		return err
+	}
 
 	fmt.Println("Connect to Wallet RPC...")
 	cfg := wallet.RPCConnectionConfig()
-	wallet.rPCClient.Connect(cfg, nil)
+	if err := wallet.rPCClient.Connect(cfg, nil); err != nil {
+		wallet.externalProcess.Stop()
+		return err
+	}
+	wallet.rPCClient.rpcClient = newProcessAwareRPCClient(wallet.rPCClient.rpcClient, &wallet.externalProcess)
 	fmt.Println("Wallet RPC client connected.")
 
 	return nil
@@ -195,30 +245,36 @@ type ConsoleCommandWalletCook interface {
 // Stop interrupts the running Wallet process.
 // Disconnects RPC client from the Wallet, removes cert-files produced by the node,
 // stops node process.
-func (wallet *ConsoleWallet) Stop() {
-	if !wallet.IsRunning() {
-		pin.ReportTestSetupMalfunction(fmt.Errorf("Wallet is not running"))
+func (wallet *ConsoleWallet) Stop() error {
+	crashed := wallet.externalProcess.UnexpectedExit() != nil
+	if !wallet.IsRunning() && !crashed {
+		return ErrNotRunning
 	}
 
+	// The RPC client stays connected after the process has crashed
 	if wallet.rPCClient.IsConnected() {
 		fmt.Println("Disconnect from Wallet RPC...")
 		wallet.rPCClient.Disconnect()
 	}
 
-	fmt.Println("Stop Wallet process...")
-	err := wallet.externalProcess.Stop()
-	pin.CheckTestSetupMalfunction(err)
+	if wallet.IsRunning() {
+		fmt.Println("Stop Wallet process...")
+		err := wallet.externalProcess.Stop()
+		if err != nil {
+			return err
+		}
+	}
 
 	// Delete files, RPC servers will recreate them on the next launch sequence
 	pin.DeleteFile(wallet.CertFile())
 	pin.DeleteFile(wallet.KeyFile())
-
+	return nil
 }
 
-// Dispose simply stops the Wallet process if running
+// Dispose simply stops the Wallet process if running or crashed
 func (wallet *ConsoleWallet) Dispose() error {
-	if wallet.IsRunning() {
-		wallet.Stop()
+	if wallet.IsRunning() || wallet.externalProcess.UnexpectedExit() != nil {
+		return wallet.Stop()
 	}
 	return nil
 }
@@ -230,19 +286,25 @@ func (wallet *ConsoleWallet) NewAddress(accountName string) (Address, error) {
 			GetNewAddress(accountName)
 }
 
-func (wallet *ConsoleWallet) Sync(desiredHeight int64) int64 {
-	attempt := 0
-	maxAttempt := 10
-	for wallet.SyncedHeight() < desiredHeight {
-		pin.Sleep(1000)
-		count := wallet.SyncedHeight()
-		fmt.Println("   sync to: " + strconv.FormatInt(count, 10))
-		attempt++
-		if maxAttempt <= attempt {
-
+// Sync block until the wallet has fully synced up to the desiredHeight
+// or the ctx is done.
+func (wallet *ConsoleWallet) Sync(ctx context.Context, desiredHeight int64, onProgress SyncProgressFunc) (int64, error) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		walletHeight := wallet.SyncedHeight()
+		if walletHeight >= desiredHeight {
+			return walletHeight, nil
+		}
+		if onProgress != nil {
+			onProgress(walletHeight, desiredHeight)
+		}
+		select {
+		case <-ctx.Done():
+			return walletHeight, newSyncError(ctx, walletHeight, desiredHeight)
+		case <-ticker.C:
 		}
 	}
-	return wallet.SyncedHeight()
 }
 
 func (wallet *ConsoleWallet) SyncedHeight() int64 {
@@ -269,9 +331,8 @@ func (wallet *ConsoleWallet) GetBalance() (*GetBalanceResult, error) {
 	return wallet.rPCClient.Connection().GetBalance()
 }
 
-func (wallet *ConsoleWallet) SendFrom(account string, address Address, amount coin.Amount) error {
-	panic("")
-	//return wallet.rPCClient.Connection().SendRawTransaction()
+func (wallet *ConsoleWallet) SendFrom(account string, address Address, amount coin.Amount) (Hash, error) {
+	return wallet.rPCClient.Connection().SendFrom(account, address, amount)
 }
 
 func (wallet *ConsoleWallet) WalletUnlock(walletPassphrase string, timeout int64) error {
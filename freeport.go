@@ -0,0 +1,170 @@
+package coinharness
+
+import (
+	"errors"
+	"fmt"
+	"github.com/jfixby/pin"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// FreePortManager issues network ports which are not in use. A port is
+// reserved by a lock file inside the LockDir, so concurrent test binaries
+// sharing the LockDir never issue the same port.
+type FreePortManager struct {
+	// BasePort is the first candidate port, ports are probed
+	// subsequently up to the MaxPort. When BasePort is zero
+	// the operating system picks the candidate ports.
+	BasePort int
+	MaxPort  int
+
+	// LockDir keeps port lock files,
+	// "coinharness-ports" in the system temp dir when not set
+	LockDir string
+
+	obtained     map[int]bool
+	registerLock sync.Mutex
+}
+
+// ObtainPort returns a free port and locks it until released
+func (man *FreePortManager) ObtainPort() int {
+	man.registerLock.Lock()
+	defer man.registerLock.Unlock()
+
+	if man.obtained == nil {
+		man.obtained = make(map[int]bool)
+	}
+	err := os.MkdirAll(man.lockDir(), 0700)
+	pin.CheckTestSetupMalfunction(err)
+
+	if man.BasePort == 0 {
+		return man.obtainSystemPort()
+	}
+
+	maxPort := man.MaxPort
+	if maxPort == 0 {
+		maxPort = 65535
+	}
+	for port := man.BasePort; port <= maxPort; port++ {
+		if man.tryObtain(port) {
+			return port
+		}
+	}
+	pin.ReportTestSetupMalfunction(
+		fmt.Errorf("no free ports in range %v-%v", man.BasePort, maxPort))
+	return 0
+}
+
+// ReleasePort removes the port lock
+func (man *FreePortManager) ReleasePort(port int) {
+	man.registerLock.Lock()
+	defer man.registerLock.Unlock()
+
+	if !man.obtained[port] {
+		return
+	}
+	delete(man.obtained, port)
+	os.Remove(man.lockFile(port))
+}
+
+// obtainSystemPort asks the operating system for a free port
+// until it returns a port not locked by another process
+func (man *FreePortManager) obtainSystemPort() int {
+	for attempt := 0; attempt < 100; attempt++ {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		pin.CheckTestSetupMalfunction(err)
+		port := listener.Addr().(*net.TCPAddr).Port
+		listener.Close()
+
+		if man.tryObtain(port) {
+			return port
+		}
+	}
+	pin.ReportTestSetupMalfunction(fmt.Errorf("unable to obtain a free port"))
+	return 0
+}
+
+// tryObtain locks the port if it is free
+func (man *FreePortManager) tryObtain(port int) bool {
+	if man.obtained[port] || !man.lock(port) {
+		return false
+	}
+	if !isPortFree(port) {
+		os.Remove(man.lockFile(port))
+		return false
+	}
+	man.obtained[port] = true
+	return true
+}
+
+// lock creates the port lock file
+func (man *FreePortManager) lock(port int) bool {
+	return acquireLockFile(man.lockFile(port))
+}
+
+// acquireLockFile creates the lock file holding the process id,
+// stale locks left by exited processes are taken over
+func acquireLockFile(file string) bool {
+	if createLockFile(file) {
+		return true
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err == nil && isProcessAlive(pid) {
+		return false
+	}
+	os.Remove(file)
+	return createLockFile(file)
+}
+
+func (man *FreePortManager) lockDir() string {
+	if man.LockDir != "" {
+		return man.LockDir
+	}
+	return filepath.Join(os.TempDir(), "coinharness-ports")
+}
+
+func (man *FreePortManager) lockFile(port int) string {
+	return filepath.Join(man.lockDir(), strconv.Itoa(port)+".lock")
+}
+
+// createLockFile atomically creates the file with the current process id
+func createLockFile(file string) bool {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	f.WriteString(strconv.Itoa(os.Getpid()))
+	return true
+}
+
+// isPortFree checks nothing listens the port on the local host
+func isPortFree(port int) bool {
+	listener, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	listener.Close()
+	return true
+}
+
+// isProcessAlive reports whether the process exists, processes which
+// can not be checked on this platform are considered alive
+func isProcessAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	err = process.Signal(syscall.Signal(0))
+	return !errors.Is(err, os.ErrProcessDone)
+}
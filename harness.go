@@ -3,6 +3,8 @@ package coinharness
 import (
 	"fmt"
 	"os"
+	"sync"
+	"testing"
 )
 
 // Harness provides a unified platform for creating RPC-driven
@@ -18,6 +20,75 @@ type Harness struct {
 	WorkingDir string
 
 	MiningAddress Address
+
+	// ports are obtained from the NetPortManager for the harness
+	ports []int
+
+	// onProcessExit is invoked when the node or the wallet process
+	// exits without being stopped
+	onProcessExit func(harness *Harness, exit *ProcessExitError)
+
+	// failed is set when a test using the harness has failed
+	// or a harness process has exited unexpectedly
+	failed bool
+
+	// mtx guards the onProcessExit and the failed
+	mtx sync.Mutex
+}
+
+// ProcessWatcher is implemented by harness components running an external
+// process, which reports the process exiting without being stopped
+type ProcessWatcher interface {
+	// SetOnProcessExit registers the callback invoked when the process
+	// exits without being stopped
+	SetOnProcessExit(onExit func(exit *ProcessExitError))
+}
+
+// SetProcessExitHandler registers the handler invoked when the node or
+// the wallet process exits without being stopped. It is safe to call while
+// the processes are watched.
+func (harness *Harness) SetProcessExitHandler(handler func(harness *Harness, exit *ProcessExitError)) {
+	harness.mtx.Lock()
+	defer harness.mtx.Unlock()
+	harness.onProcessExit = handler
+}
+
+// WatchProcesses reports unexpected exits of the node and the wallet
+// processes to the handler set by the SetProcessExitHandler
+func (harness *Harness) WatchProcesses() {
+	onExit := func(exit *ProcessExitError) {
+		harness.mtx.Lock()
+		harness.failed = true
+		handler := harness.onProcessExit
+		harness.mtx.Unlock()
+		if handler != nil {
+			handler(harness, exit)
+		}
+	}
+	if watcher, ok := harness.Node.(ProcessWatcher); ok {
+		watcher.SetOnProcessExit(onExit)
+	}
+	if watcher, ok := harness.Wallet.(ProcessWatcher); ok {
+		watcher.SetOnProcessExit(onExit)
+	}
+}
+
+// ProcessLogger is implemented by harness components running an external
+// process, which output is captured into a log file inside the harness
+// WorkingDir
+type ProcessLogger interface {
+	// LogPath returns file path of the process stdout and stderr log
+	LogPath() string
+
+	// TailLog returns the last n lines of the process log
+	TailLog(n int) ([]string, error)
+}
+
+// ExecutableRunner is implemented by harness components running an external
+// process, the ChainSnapshotCache keys snapshots by the executable content
+type ExecutableRunner interface {
+	// Executable returns path or name of the process executable
+	Executable() string
 }
 
 // WalletRPCClient manages access to the RPCClient,
@@ -32,6 +103,44 @@ func (harness *Harness) NodeRPCClient() RPCClient {
 	return harness.Node.RPCClient().rpcClient
 }
 
+// LogPaths returns paths of the node and wallet process logs
+// captured by the harness
+func (harness *Harness) LogPaths() []string {
+	paths := []string{}
+	if logger, ok := harness.Node.(ProcessLogger); ok {
+		paths = append(paths, logger.LogPath())
+	}
+	if logger, ok := harness.Wallet.(ProcessLogger); ok {
+		paths = append(paths, logger.LogPath())
+	}
+	return paths
+}
+
+// ObserveTest marks the harness failed when the test fails. The WorkingDir
+// of a failed harness is kept on Dispose for the post-mortem.
+func (harness *Harness) ObserveTest(t testing.TB) {
+	t.Cleanup(func() {
+		if t.Failed() {
+			harness.MarkFailed()
+		}
+	})
+}
+
+// MarkFailed marks the harness failed
+func (harness *Harness) MarkFailed() {
+	harness.mtx.Lock()
+	defer harness.mtx.Unlock()
+	harness.failed = true
+}
+
+// Failed reports whether a test using the harness has failed
+// or a harness process has exited unexpectedly
+func (harness *Harness) Failed() bool {
+	harness.mtx.Lock()
+	defer harness.mtx.Unlock()
+	return harness.failed
+}
+
 // DeleteWorkingDir removes harness working directory
 func (harness *Harness) DeleteWorkingDir() error {
 	dir := harness.WorkingDir
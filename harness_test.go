@@ -0,0 +1,43 @@
+package coinharness
+
+import (
+	"sync"
+	"testing"
+)
+
+// watchedNode captures the process exit callback
+type watchedNode struct {
+	disposableNode
+	onExit func(exit *ProcessExitError)
+}
+
+func (node *watchedNode) SetOnProcessExit(onExit func(exit *ProcessExitError)) {
+	node.onExit = onExit
+}
+
+func TestSetProcessExitHandlerWhileWatched(t *testing.T) {
+	node := &watchedNode{}
+	harness := &Harness{Node: node, Wallet: &disposableWallet{}}
+	harness.WatchProcesses()
+
+	// The process exits while the test sets the handler
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		node.onExit(&ProcessExitError{})
+	}()
+	reported := make(chan *ProcessExitError, 2)
+	harness.SetProcessExitHandler(func(h *Harness, exit *ProcessExitError) {
+		reported <- exit
+	})
+	wg.Wait()
+
+	node.onExit(&ProcessExitError{})
+	if len(reported) == 0 {
+		t.Fatal("process exit is not reported")
+	}
+	if !harness.Failed() {
+		t.Fatal("harness is not failed after the process exit")
+	}
+}
@@ -1,10 +1,10 @@
 package coinharness
 
 import (
+	"context"
 	"fmt"
 	"github.com/jfixby/coin"
 	"github.com/jfixby/pin"
-	"reflect"
 	"testing"
 	"time"
 )
@@ -22,8 +22,42 @@ const (
 	// Mempools is a JoinType which blocks until all nodes have identical
 	// mempool.
 	Mempools
+
+	// BestBlockHash is a JoinType which waits until all nodes share the same
+	// best block hash.
+	BestBlockHash
+
+	// Wallets is a JoinType which waits until the wallet of each harness
+	// is synced to the best block height of its node.
+	Wallets
+
+	// Peers is a JoinType which waits until each node has the minimum
+	// number of peers. The minimum is passed as the int command,
+	// the number of other nodes when the command is nil.
+	Peers
 )
 
+// String returns the JoinType name
+func (joinType JoinType) String() string {
+	switch joinType {
+	case Blocks:
+		return "Blocks"
+	case Mempools:
+		return "Mempools"
+	case BestBlockHash:
+		return "BestBlockHash"
+	case Wallets:
+		return "Wallets"
+	case Peers:
+		return "Peers"
+	}
+	return fmt.Sprintf("JoinType(%v)", uint8(joinType))
+}
+
+// DefaultJoinPollInterval is the time JoinNodes waits
+// before checking the nodes again
+const DefaultJoinPollInterval = 100 * time.Millisecond
+
 // JoinNodes is a synchronization tool used to block until all passed nodes are
 // fully synced with respect to an attribute. This function will block for a
 // period of time, finally returning once all nodes are synced according to the
@@ -31,73 +65,266 @@ const (
 // harnesses are at a consistent state before proceeding to an assertion or
 // check within rpc tests.
 func JoinNodes(command interface{}, nodes []*Harness, joinType JoinType) error {
+	return JoinNodesContext(context.Background(), command, nodes, joinType, DefaultJoinPollInterval)
+}
+
+// JoinNodesContext is the JoinNodes which gives up when the ctx is done,
+// returning an error describing the state of each node. Nodes are checked
+// every pollInterval, DefaultJoinPollInterval when not set.
+func JoinNodesContext(
+	ctx context.Context,
+	command interface{},
+	nodes []*Harness,
+	joinType JoinType,
+	pollInterval time.Duration,
+) error {
+	if pollInterval <= 0 {
+		pollInterval = DefaultJoinPollInterval
+	}
 	switch joinType {
 	case Blocks:
-		return syncBlocks(nodes)
+		return syncBlocks(ctx, nodes, pollInterval)
 	case Mempools:
-		return syncMempools(command, nodes)
+		return syncMempools(ctx, command, nodes, pollInterval)
+	case BestBlockHash:
+		return pollJoin(ctx, joinType, pollInterval, func() (bool, string, error) {
+			return bestBlocksMatch(nodes)
+		})
+	case Wallets:
+		return pollJoin(ctx, joinType, pollInterval, func() (bool, string, error) {
+			return walletsSynced(nodes)
+		})
+	case Peers:
+		minPeers := len(nodes) - 1
+		if command != nil {
+			n, ok := command.(int)
+			if !ok {
+				return fmt.Errorf("peers join requires the int command, got %T", command)
+			}
+			minPeers = n
+		}
+		return pollJoin(ctx, joinType, pollInterval, func() (bool, string, error) {
+			return peersConnected(nodes, minPeers)
+		})
+	}
+	return fmt.Errorf("unknown join type: %v", joinType)
+}
+
+// pollJoin calls joined every pollInterval until it returns true.
+// Returns an error with the last state report when the ctx is done first.
+func pollJoin(
+	ctx context.Context,
+	joinType JoinType,
+	pollInterval time.Duration,
+	joined func() (bool, string, error),
+) error {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		ok, report, err := joined()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("nodes did not join by %v: %v\n%v", joinType, ctx.Err(), report)
+		case <-ticker.C:
+		}
 	}
-	return nil
 }
 
 // syncMempools blocks until all nodes have identical mempools.
-func syncMempools(command interface{}, nodes []*Harness) error {
-	poolsMatch := false
+func syncMempools(ctx context.Context, command interface{}, nodes []*Harness, pollInterval time.Duration) error {
+	return pollJoin(ctx, Mempools, pollInterval, func() (bool, string, error) {
+		return mempoolsMatch(command, nodes)
+	})
+}
 
-	for !poolsMatch {
-	retry:
-		firstPool, err := nodes[0].NodeRPCClient().GetRawMempool(command)
+// mempoolsMatch checks all nodes have identical sets of mempool
+// transactions, otherwise reports the differences.
+func mempoolsMatch(command interface{}, nodes []*Harness) (bool, string, error) {
+	diffs, err := DiffMempools(command, nodes)
+	if err != nil {
+		return false, "", err
+	}
+	report := ""
+	for _, diff := range diffs {
+		report += diff.String()
+	}
+	return len(diffs) == 0, report, nil
+}
+
+// MempoolDiff describes how the mempool of the Node differs
+// from the mempool of the Reference node
+type MempoolDiff struct {
+	Reference *Harness
+	Node      *Harness
+
+	// Missing transactions are in the Reference mempool only
+	Missing []Hash
+
+	// Extra transactions are in the Node mempool only
+	Extra []Hash
+}
+
+// String lists the missing and extra transactions
+func (diff *MempoolDiff) String() string {
+	report := ""
+	for _, hash := range diff.Missing {
+		report += fmt.Sprintf("%v: missing on %v, present on %v\n",
+			hash, diff.Node.Name, diff.Reference.Name)
+	}
+	for _, hash := range diff.Extra {
+		report += fmt.Sprintf("%v: extra on %v, absent on %v\n",
+			hash, diff.Node.Name, diff.Reference.Name)
+	}
+	return report
+}
+
+// DiffMempools compares mempools of the nodes with the mempool of the first
+// node regardless of the transactions order. Returns differences of the nodes
+// which mempools do not match, none when all mempools are identical.
+func DiffMempools(command interface{}, nodes []*Harness) ([]*MempoolDiff, error) {
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	reference := nodes[0]
+	referencePool, err := reference.NodeRPCClient().GetRawMempool(command)
+	if err != nil {
+		return nil, err
+	}
+	referenceSet := hashSet(referencePool)
+
+	diffs := []*MempoolDiff{}
+	for _, node := range nodes[1:] {
+		nodePool, err := node.NodeRPCClient().GetRawMempool(command)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		nodeSet := hashSet(nodePool)
 
-		// If all nodes have an identical mempool with respect to the
-		// first node, then we're done. Otherwise, drop back to the top
-		// of the loop and retry after a short wait period.
-		for _, node := range nodes[1:] {
-			nodePool, err := node.NodeRPCClient().GetRawMempool(command)
-			if err != nil {
-				return err
+		diff := &MempoolDiff{Reference: reference, Node: node}
+		for _, hash := range referencePool {
+			if _, ok := nodeSet[hashToString(hash)]; !ok {
+				diff.Missing = append(diff.Missing, hash)
 			}
-			eq := reflect.DeepEqual(firstPool, nodePool)
-			//eq := firstPool.EqualsTo(nodePool)
-			if !eq {
-				time.Sleep(time.Millisecond * 100)
-				goto retry
+		}
+		for _, hash := range nodePool {
+			if _, ok := referenceSet[hashToString(hash)]; !ok {
+				diff.Extra = append(diff.Extra, hash)
 			}
 		}
+		if len(diff.Missing) > 0 || len(diff.Extra) > 0 {
+			diffs = append(diffs, diff)
+		}
+	}
+	return diffs, nil
+}
 
-		poolsMatch = true
+// AssertMempoolsEqual checks all nodes have identical sets
+// of mempool transactions
+func AssertMempoolsEqual(t *testing.T, command interface{}, nodes ...*Harness) {
+	diffs, err := DiffMempools(command, nodes)
+	if err != nil {
+		t.Fatalf("unable to get mempool: %v", err)
+	}
+	if len(diffs) == 0 {
+		return
 	}
+	report := ""
+	for _, diff := range diffs {
+		report += diff.String()
+	}
+	t.Fatalf("mempools do not match:\n%v", report)
+}
 
-	return nil
+// hashSet returns the set of hashes keyed by their string form
+func hashSet(hashes []Hash) map[string]struct{} {
+	set := make(map[string]struct{}, len(hashes))
+	for _, hash := range hashes {
+		set[hashToString(hash)] = struct{}{}
+	}
+	return set
 }
 
 // syncBlocks blocks until all nodes report the same block height.
-func syncBlocks(nodes []*Harness) error {
-	blocksMatch := false
-
-	for !blocksMatch {
-	retry:
-		blockHeights := make(map[int64]struct{})
+func syncBlocks(ctx context.Context, nodes []*Harness, pollInterval time.Duration) error {
+	return pollJoin(ctx, Blocks, pollInterval, func() (bool, string, error) {
+		return blocksMatch(nodes)
+	})
+}
 
-		for _, node := range nodes {
-			blockHeight, err := node.NodeRPCClient().GetBlockCount()
-			if err != nil {
-				return err
-			}
+// blocksMatch checks all nodes report the same block height,
+// otherwise reports height of each node.
+func blocksMatch(nodes []*Harness) (bool, string, error) {
+	blockHeights := make(map[int64]struct{})
+	report := ""
+	for _, node := range nodes {
+		blockHeight, err := node.NodeRPCClient().GetBlockCount()
+		if err != nil {
+			return false, "", err
+		}
+		blockHeights[blockHeight] = struct{}{}
+		report += fmt.Sprintf("%v height: %v\n", node.Name, blockHeight)
+	}
+	return len(blockHeights) <= 1, report, nil
+}
 
-			blockHeights[blockHeight] = struct{}{}
-			if len(blockHeights) > 1 {
-				time.Sleep(time.Millisecond * 100)
-				goto retry
-			}
+// bestBlocksMatch checks all nodes report the same best block hash,
+// otherwise reports the best block of each node.
+func bestBlocksMatch(nodes []*Harness) (bool, string, error) {
+	hashes := make(map[string]struct{})
+	report := ""
+	for _, node := range nodes {
+		hash, height, err := node.NodeRPCClient().GetBestBlock()
+		if err != nil {
+			return false, "", err
 		}
+		hashes[hashToString(hash)] = struct{}{}
+		report += fmt.Sprintf("%v best block: %v at %v\n", node.Name, hash, height)
+	}
+	return len(hashes) <= 1, report, nil
+}
 
-		blocksMatch = true
+// walletsSynced checks the wallet of each harness is synced to the best
+// block height of its node, otherwise reports both heights of each harness.
+func walletsSynced(nodes []*Harness) (bool, string, error) {
+	synced := true
+	report := ""
+	for _, node := range nodes {
+		_, nodeHeight, err := node.NodeRPCClient().GetBestBlock()
+		if err != nil {
+			return false, "", err
+		}
+		walletHeight := node.Wallet.SyncedHeight()
+		if walletHeight != nodeHeight {
+			synced = false
+		}
+		report += fmt.Sprintf("%v node height: %v, wallet height: %v\n",
+			node.Name, nodeHeight, walletHeight)
 	}
+	return synced, report, nil
+}
 
-	return nil
+// peersConnected checks each node has at least minPeers peers,
+// otherwise reports the number of peers of each node.
+func peersConnected(nodes []*Harness, minPeers int) (bool, string, error) {
+	connected := true
+	report := ""
+	for _, node := range nodes {
+		peerInfo, err := node.NodeRPCClient().GetPeerInfo()
+		if err != nil {
+			return false, "", err
+		}
+		if len(peerInfo) < minPeers {
+			connected = false
+		}
+		report += fmt.Sprintf("%v peers: %v\n", node.Name, len(peerInfo))
+	}
+	return connected, report, nil
 }
 
 // ConnectNode establishes a new peer-to-peer connection between the "from"
@@ -136,6 +363,126 @@ func ConnectNode(from *Harness, to *Harness, command interface{}) error {
 	return fmt.Errorf("failed to connet node")
 }
 
+// DisconnectNode drops the peer-to-peer connection between the harnesses
+// established in either direction. The persistent peer is removed first,
+// so the node does not reconnect. Blocks until the peer is gone from
+// the GetPeerInfo of both nodes.
+func DisconnectNode(from *Harness, to *Harness) error {
+	var disconnectErr error
+	for _, pair := range [][2]*Harness{{from, to}, {to, from}} {
+		node, peer := pair[0], pair[1]
+		conn, err := connectionBetween(node, peer)
+		if err != nil {
+			return err
+		}
+
+		addrs := conn.inbound
+		if conn.outbound {
+			// The peer is not persistent when it was connected with
+			// the onetry command, so the remove error is ignored
+			node.NodeRPCClient().AddNode(&AddNodeArguments{
+				TargetAddr: peer.P2PAddress(),
+				Command:    AddNodeRemove,
+			})
+			addrs = append(addrs, peer.P2PAddress())
+		}
+		for _, addr := range addrs {
+			err := node.NodeRPCClient().DisconnectNode(addr)
+			if err != nil {
+				// The remove command disconnects the peer on some nodes,
+				// the error matters when the peer stays connected
+				disconnectErr = err
+			}
+		}
+	}
+
+	// Block until the connection is gone.
+	for attempts := 5; attempts > 0; attempts-- {
+		connected, err := IsConnectedTo(from, to)
+		if err != nil {
+			return err
+		}
+		if !connected {
+			return nil
+		}
+		pin.Sleep(1000)
+	}
+
+	if disconnectErr != nil {
+		return disconnectErr
+	}
+	return fmt.Errorf("failed to disconnect node %v from %v", from.Name, to.Name)
+}
+
+// IsConnectedTo checks the node and the peer harness are connected
+// in either direction, the GetPeerInfo of both nodes is checked
+func IsConnectedTo(node *Harness, peer *Harness) (bool, error) {
+	conn, err := connectionBetween(node, peer)
+	if err != nil {
+		return false, err
+	}
+	return conn.connected(), nil
+}
+
+// peerConnection describes connections of the node to the peer harness
+type peerConnection struct {
+	// outbound is true when the node is connected to the peer P2PAddress
+	outbound bool
+
+	// inbound lists the node peer addresses of connections
+	// from the peer, matched on the peer AddrLocal
+	inbound []string
+
+	// unmatched is true when the peer is connected to the node
+	// but does not report the AddrLocal of the connection
+	unmatched bool
+}
+
+func (conn *peerConnection) connected() bool {
+	return conn.outbound || len(conn.inbound) > 0 || conn.unmatched
+}
+
+// connectionBetween finds connections of the node to the peer harness.
+// An inbound peer is listed under the address of its outgoing socket,
+// so it is matched on the AddrLocal of the peer outbound connection.
+func connectionBetween(node *Harness, peer *Harness) (*peerConnection, error) {
+	nodePeers, err := node.NodeRPCClient().GetPeerInfo()
+	if err != nil {
+		return nil, err
+	}
+	peerPeers, err := peer.NodeRPCClient().GetPeerInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &peerConnection{}
+	peerAddr := peer.P2PAddress()
+	for _, info := range nodePeers {
+		if info.Addr == peerAddr {
+			conn.outbound = true
+		}
+	}
+
+	nodeAddr := node.P2PAddress()
+	localAddrs := make(map[string]bool)
+	for _, info := range peerPeers {
+		if info.Addr != nodeAddr {
+			continue
+		}
+		if info.AddrLocal == "" {
+			conn.unmatched = true
+		} else {
+			localAddrs[info.AddrLocal] = true
+		}
+	}
+	for _, info := range nodePeers {
+		if localAddrs[info.Addr] {
+			conn.inbound = append(conn.inbound, info.Addr)
+		}
+	}
+	return conn, nil
+}
+
 func AssertConnectedTo(t *testing.T, nodeA *Harness, nodeB *Harness) {
 	nodeAPeers, err := nodeA.NodeRPCClient().GetPeerInfo()
 	if err != nil {
@@ -167,6 +514,8 @@ func GenerateTestChain(numToGenerate int64, node RPCClient) error {
 	return nil
 }
 
+// GenSpend sends amt to a new address of the harness wallet,
+// see CreateTransactionArgs.NewHashFromStr for parsing of the Unspent TxIDs
 func GenSpend(
 	t *testing.T,
 	r *Harness,
@@ -175,6 +524,22 @@ func GenSpend(
 	PkScriptVersion uint16,
 	PayToAddrScript func(Address) ([]byte, error),
 	TxSerializeSize func(*MessageTx) int,
+) Hash {
+	return GenSpendWithHashParser(t, r, account, amt, PkScriptVersion,
+		PayToAddrScript, TxSerializeSize, nil)
+}
+
+// GenSpendWithHashParser is the GenSpend parsing Unspent TxIDs
+// with the NewHashFromStr
+func GenSpendWithHashParser(
+	t *testing.T,
+	r *Harness,
+	account string,
+	amt coin.Amount,
+	PkScriptVersion uint16,
+	PayToAddrScript func(Address) ([]byte, error),
+	TxSerializeSize func(*MessageTx) int,
+	NewHashFromStr func(string) (Hash, error),
 ) Hash {
 	pin.AssertNotEmpty("account", account)
 	// Grab a fresh address from the wallet.
@@ -200,6 +565,7 @@ func GenSpend(
 		FeeRate:         coin.FromFloat(10),
 		PayToAddrScript: PayToAddrScript,
 		TxSerializeSize: TxSerializeSize,
+		NewHashFromStr:  NewHashFromStr,
 		Account:         account,
 	}
 
@@ -207,7 +573,7 @@ func GenSpend(
 	if err != nil {
 		t.Fatalf("coinbase spend failed: %v", err)
 	}
-	return txid.TxHash
+	return txid.TxHash()
 }
 
 func AssertTxMined(t *testing.T, r *Harness, txid Hash, blockHash Hash) {
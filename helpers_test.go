@@ -0,0 +1,112 @@
+package coinharness
+
+import (
+	"fmt"
+	"testing"
+)
+
+// fakeConnection is the outbound connection from the node P2P address
+// to the target one using the local socket address
+type fakeConnection struct {
+	node   string
+	target string
+	socket string
+}
+
+// fakePeerNetwork keeps connections of fake nodes
+type fakePeerNetwork struct {
+	connections []fakeConnection
+}
+
+func (network *fakePeerNetwork) connect(node string, target string, socket string) {
+	network.connections = append(network.connections, fakeConnection{node, target, socket})
+}
+
+// peerInfo returns the connections as seen by the node
+func (network *fakePeerNetwork) peerInfo(node string) []PeerInfo {
+	peers := []PeerInfo{}
+	for _, conn := range network.connections {
+		if conn.node == node {
+			peers = append(peers, PeerInfo{Addr: conn.target, AddrLocal: conn.socket})
+		}
+		if conn.target == node {
+			peers = append(peers, PeerInfo{Addr: conn.socket, AddrLocal: conn.target})
+		}
+	}
+	return peers
+}
+
+// peerRPCClient is the RPC client of the fake node with the P2P address
+type peerRPCClient struct {
+	fakeRPCClient
+	network *fakePeerNetwork
+	address string
+}
+
+func (c *peerRPCClient) GetPeerInfo() ([]PeerInfo, error) {
+	return c.network.peerInfo(c.address), nil
+}
+
+func (c *peerRPCClient) AddNode(args *AddNodeArguments) error {
+	return nil
+}
+
+func (c *peerRPCClient) DisconnectNode(targetAddr string) error {
+	for i, conn := range c.network.connections {
+		if (conn.node == c.address && conn.target == targetAddr) ||
+			(conn.target == c.address && conn.socket == targetAddr) {
+			c.network.connections = append(c.network.connections[:i], c.network.connections[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("peer %v not found", targetAddr)
+}
+
+// p2pNode listens on the P2P address
+type p2pNode struct {
+	rpcNode
+	address string
+}
+
+func (node *p2pNode) P2PAddress() string {
+	return node.address
+}
+
+func newPeerHarness(network *fakePeerNetwork, address string) *Harness {
+	client := &peerRPCClient{network: network, address: address}
+	return &Harness{
+		Name: address,
+		Node: &p2pNode{rpcNode: rpcNode{client: client}, address: address},
+	}
+}
+
+func TestIsConnectedToChecksInboundSide(t *testing.T) {
+	network := &fakePeerNetwork{}
+	a := newPeerHarness(network, "127.0.0.1:1001")
+	b := newPeerHarness(network, "127.0.0.1:1002")
+	c := newPeerHarness(network, "127.0.0.1:1003")
+
+	// The inbound peer of the b is not the a
+	network.connect(c.P2PAddress(), b.P2PAddress(), "127.0.0.1:5003")
+	if connected, _ := IsConnectedTo(b, a); connected {
+		t.Fatalf("b is connected to a through the inbound peer of c")
+	}
+
+	network.connect(a.P2PAddress(), b.P2PAddress(), "127.0.0.1:5001")
+	for _, pair := range [][2]*Harness{{a, b}, {b, a}} {
+		if connected, _ := IsConnectedTo(pair[0], pair[1]); !connected {
+			t.Fatalf("%v is not connected to %v", pair[0].Name, pair[1].Name)
+		}
+	}
+
+	// The connection is dropped from the inbound side
+	if err := DisconnectNode(b, a); err != nil {
+		t.Fatalf("unable to disconnect: %v", err)
+	}
+	if connected, _ := IsConnectedTo(a, b); connected {
+		t.Fatalf("a is connected to b after the disconnect")
+	}
+	if connected, _ := IsConnectedTo(b, c); !connected {
+		t.Fatalf("b is disconnected from c")
+	}
+}
@@ -2,8 +2,12 @@ package coinharness
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
 	"github.com/jfixby/coin"
 	"github.com/jfixby/pin"
+	"os"
 	"sync"
 	"time"
 )
@@ -19,17 +23,36 @@ type InMemoryWallet struct {
 	// HdRoot is the root master private key for the wallet.
 	HdRoot ExtendedKey //*hdkeychain.ExtendedKey
 
-	// HdIndex is the next available key index offset from the HdRoot.
+	// HdIndex is the next available key index offset from the HdRoot
+	// for the default account.
 	HdIndex uint32
 
 	// currentHeight is the latest height the wallet is known to be synced
 	// to.
 	currentHeight int64
 
-	// addrs tracks all addresses belonging to the wallet. The addresses
-	// are indexed by their keypath from the HdRoot.
+	// currentHash is the hash of the block at the currentHeight
+	currentHash Hash
+
+	// reorgHeight is the height of the new best chain while the
+	// node reorganizes the chain, zero otherwise
+	reorgHeight int64
+
+	// reorgHash is the hash of the new best chain tip
+	// while the node reorganizes the chain
+	reorgHash Hash
+
+	// addrs tracks all addresses belonging to the default account.
+	// The addresses are indexed by their keypath from the HdRoot.
 	Addrs map[uint32]Address
 
+	// accounts tracks accounts created by the CreateNewAccount
+	accounts map[string]*memWalletAccount
+
+	// AddressGapLimit is the number of consecutive unused addresses
+	// the Rescan looks ahead, DefaultAddressGapLimit when not set
+	AddressGapLimit uint32
+
 	// Utxos is the set of Utxos spendable by the wallet.
 	Utxos map[OutPoint]*Utxo
 
@@ -39,6 +62,14 @@ type InMemoryWallet struct {
 	// disconnected block on the wallet's set of spendable Utxos.
 	ReorgJournal map[int64]*UndoEntry
 
+	// mempool tracks unmined transactions relevant to the wallet
+	mempool mempoolState
+
+	// MempoolCommand is the chain-specific command passed to the
+	// GetRawMempool to check the tracked unmined transactions are
+	// still in the node mempool
+	MempoolCommand interface{}
+
 	chainUpdates []*chainUpdate
 
 	// chainUpdateSignal is a wallet event queue
@@ -46,8 +77,15 @@ type InMemoryWallet struct {
 
 	chainMtx sync.Mutex
 
+	// syncerDone is closed when the chainSyncer exits
+	syncerDone chan struct{}
+
 	Net Network
 
+	// WorkingDir keeps the wallet state snapshot between launches,
+	// the state is not persisted when empty
+	WorkingDir string
+
 	nodeRPC RPCClient
 
 	sync.RWMutex
@@ -57,6 +95,16 @@ type InMemoryWallet struct {
 	IsCoinBaseTx        func(*MessageTx) bool             //blockchain.IsCoinBaseTx(mtx)
 	PrivateKeyKeyToAddr func(key PrivateKey, net Network) (Address, error)
 	ReadBlockHeader     func(header []byte) BlockHeader
+
+	// Used by SendFrom to create transactions
+	PayToAddrScript func(Address) ([]byte, error) // txscript.PayToAddrScript(addr)
+	TxSerializeSize func(*MessageTx) int          // *wire.MsgTx.TxSerializeSize()
+	NewHashFromStr  func(string) (Hash, error)    // chainhash.NewHashFromStr(txid)
+	FeeRate         coin.Amount                   // atoms-per-byte, DefaultFeeRate when not set
+
+	// SignatureScript produces a signature script for the input idx
+	// of the tx spending an output locked by the subScript.
+	SignatureScript func(tx *MessageTx, idx int, subScript []byte, key PrivateKey) ([]byte, error) //txscript.SignatureScript(...)
 }
 
 const chainUpdateSignal = "chainUpdateSignal"
@@ -66,14 +114,38 @@ const stopSignal = "stopSignal"
 // used to sync up the InMemoryWallet each time a new block is connected to the main
 // chain.
 type chainUpdate struct {
+	updateType   chainUpdateType
 	blockHeight  int64
+	blockHash    Hash
 	filteredTxns []*Tx
+
+	// done is closed when the updatesApplied update is reached
+	done chan struct{}
 }
 
+// chainUpdateType distinguishes events of the chainUpdates queue
+type chainUpdateType uint8
+
+const (
+	// blockConnected updates the wallet with a new block
+	blockConnected chainUpdateType = iota
+
+	// blockDisconnected unwinds the last connected block
+	blockDisconnected
+
+	// chainReorganized marks beginning of a chain reorganization,
+	// blockHeight is the height of the new best chain
+	chainReorganized
+
+	// updatesApplied reports the updates queued before it are applied
+	updatesApplied
+)
+
 // UndoEntry is functionally the opposite of a chainUpdate. An UndoEntry is
 // created for each new block received, then stored in a log in order to
 // properly handle block re-orgs.
 type UndoEntry struct {
+	blockHash      Hash
 	utxosDestroyed map[OutPoint]*Utxo
 	utxosCreated   []OutPoint
 }
@@ -84,7 +156,9 @@ type UndoEntry struct {
 type Utxo struct {
 	pkScript       []byte
 	value          coin.Amount
+	blockHeight    int64
 	maturityHeight int64
+	account        string
 	keyIndex       uint32
 	isLocked       bool
 }
@@ -108,8 +182,48 @@ func (wallet *InMemoryWallet) ListAccounts() (map[string]coin.Amount, error) {
 	return r, nil
 }
 
-func (wallet *InMemoryWallet) SendFrom(account string, address Address, amount coin.Amount) error {
-	panic("implement me")
+// SendFrom creates a signed transaction paying the amount from the account
+// to the address and broadcasts it via the node.
+func (wallet *InMemoryWallet) SendFrom(account string, address Address, amount coin.Amount) (Hash, error) {
+	args, err := wallet.sendFromArgs(account, address, amount)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := CreateTransaction(wallet, args)
+	if err != nil {
+		return nil, err
+	}
+
+	txHash, err := wallet.nodeRPC.SendRawTransaction(tx, true)
+	if err != nil {
+		wallet.UnlockOutputs(txInputs(tx))
+		return nil, err
+	}
+	return txHash, nil
+}
+
+// sendFromArgs returns CreateTransaction arguments of the SendFrom,
+// the DefaultFeeRate is used when the wallet FeeRate is not set
+func (wallet *InMemoryWallet) sendFromArgs(account string, address Address, amount coin.Amount) (*CreateTransactionArgs, error) {
+	pkScript, err := wallet.PayToAddrScript(address)
+	if err != nil {
+		return nil, err
+	}
+	feeRate := wallet.FeeRate
+	if feeRate.AtomsValue == 0 {
+		feeRate = DefaultFeeRate
+	}
+	return &CreateTransactionArgs{
+		Outputs: []*TxOut{{
+			Value:    amount.Copy(),
+			PkScript: pkScript,
+		}},
+		FeeRate:         feeRate,
+		PayToAddrScript: wallet.PayToAddrScript,
+		TxSerializeSize: wallet.TxSerializeSize,
+		NewHashFromStr:  wallet.NewHashFromStr,
+		Account:         account,
+	}, nil
 }
 
 // Network returns current network of the wallet
@@ -144,52 +258,125 @@ func (wallet *InMemoryWallet) Start(args *TestWalletStartArgs) error {
 	} else {
 		handlers.OnBlockDisconnected = wallet.UnwindBlock
 	}
+	handlers.OnReorganization = wallet.OnReorganization
+	handlers.OnRelevantTxAccepted = wallet.IngestMempoolTx
+	// The restarted node might have lost the unmined transactions
+	handlers.OnClientConnected = wallet.refreshMempool
+
+	// Restore the state saved by the previous launch
+	loaded := false
+	if wallet.WorkingDir != "" {
+		if _, err := os.Stat(wallet.StateFile()); err == nil {
+			if err := wallet.Load(wallet.StateFile()); err != nil {
+				return err
+			}
+			loaded = true
+		}
+	}
 
-	wallet.nodeRPC = NewRPCConnection(wallet.RPCClientFactory, args.NodeRPCConfig, 5, handlers)
-	pin.AssertNotNil("nodeRPC", wallet.nodeRPC)
+	wallet.Lock()
+	if wallet.mempool.txs == nil {
+		wallet.mempool = newMempoolState()
+	}
+	wallet.Unlock()
+
+	nodeRPC := NewRPCConnection(wallet.RPCClientFactory, args.NodeRPCConfig, 5, handlers)
+	pin.AssertNotNil("nodeRPC", nodeRPC)
+	wallet.Lock()
+	wallet.nodeRPC = nodeRPC
+	wallet.Unlock()
 
 	// Filter transactions that pay to the coinbase associated with the
 	// wallet.
 	wallet.updateTxFilter()
 
+	wallet.syncerDone = make(chan struct{})
+	go wallet.chainSyncer(wallet.syncerDone)
+
+	// The node chain might have been reorganized while the wallet was stopped
+	if loaded {
+		if err := wallet.unwindStaleBlocks(); err != nil {
+			return err
+		}
+	}
+	missedFrom := wallet.SyncedHeight() + 1
+
 	// Ensure node properly dispatches our registered call-back for each new
 	// block. Otherwise, the InMemoryWallet won't function properly.
 	err := wallet.nodeRPC.NotifyBlocks()
 	pin.CheckTestSetupMalfunction(err)
 
-	go wallet.chainSyncer()
+	// Catch up on the blocks mined while the wallet was stopped. Blocks
+	// reported by the node in the meantime may be applied first, the rescan
+	// of the lower blocks keeps the synced height.
+	if loaded {
+		return wallet.rescanMissedBlocks(missedFrom)
+	}
 	return nil
 }
 
 func (wallet *InMemoryWallet) updateTxFilter() {
 	filterAddrs := []Address{}
-	for _, v := range wallet.Addrs {
-		filterAddrs = append(filterAddrs, v)
+	for _, v := range wallet.addresses() {
+		filterAddrs = append(filterAddrs, v.addr)
 	}
 	err := wallet.nodeRPC.LoadTxFilter(true, filterAddrs)
 	pin.CheckTestSetupMalfunction(err)
 }
 
-// Stop wallet process gently, by sending stopSignal to the wallet event queue
-func (wallet *InMemoryWallet) Stop() {
-	go func() {
-		wallet.ChainUpdateSignal <- stopSignal
-	}()
-	wallet.nodeRPC.Disconnect()
+// Stop wallet process gently, by sending stopSignal to the wallet event queue.
+// Chain updates queued before the stop are processed, then the wallet state
+// snapshot is saved into the WorkingDir.
+func (wallet *InMemoryWallet) Stop() error {
+	if wallet.syncerDone == nil {
+		return ErrNotRunning
+	}
+	// No new chain updates are reported after the disconnect
+	wallet.Lock()
+	nodeRPC := wallet.nodeRPC
 	wallet.nodeRPC = nil
+	wallet.Unlock()
+	nodeRPC.Disconnect()
+
+	wallet.ChainUpdateSignal <- stopSignal
+	<-wallet.syncerDone
+	wallet.syncerDone = nil
+
+	if wallet.WorkingDir != "" {
+		return wallet.Save(wallet.StateFile())
+	}
+	return nil
 }
 
-// Sync block until the wallet has fully synced up to the tip of the main
-// chain.
-func (wallet *InMemoryWallet) Sync(desiredHeight int64) int64 {
+// Sync block until the wallet has fully synced up to the desiredHeight
+// or the ctx is done.
+func (wallet *InMemoryWallet) Sync(ctx context.Context, desiredHeight int64, onProgress SyncProgressFunc) (int64, error) {
 	ticker := time.NewTicker(time.Millisecond * 100)
-	for range ticker.C {
+	defer ticker.Stop()
+	for {
 		walletHeight := wallet.SyncedHeight()
-		if walletHeight >= desiredHeight {
-			break
+		if walletHeight >= desiredHeight && !wallet.isReorganizing() {
+			return walletHeight, nil
+		}
+		if onProgress != nil {
+			onProgress(walletHeight, desiredHeight)
+		}
+		select {
+		case <-ctx.Done():
+			return walletHeight, newSyncError(ctx, walletHeight, desiredHeight)
+		case <-ticker.C:
 		}
 	}
-	return wallet.SyncedHeight()
+}
+
+// isReorganizing returns true while the wallet is switching to the new
+// best chain reported by the OnReorganization.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) isReorganizing() bool {
+	wallet.RLock()
+	defer wallet.RUnlock()
+	return wallet.reorgHeight != 0
 }
 
 // Dispose is no needed for InMemoryWallet
@@ -228,10 +415,51 @@ func (m *InMemoryWallet) IngestBlock(headerBytes []byte, filteredTxns [][]byte)
 		txns = append(txns, tx)
 	}
 
-	// Append this new chain update to the end of the queue of new chain
-	// updates.
+	m.pushChainUpdate(&chainUpdate{
+		updateType:   blockConnected,
+		blockHeight:  height,
+		blockHash:    header.Hash(),
+		filteredTxns: txns,
+	})
+}
+
+// UnwindBlock is a call-back which is to be executed each time a block is
+// disconnected from the main chain. Unwinding a block undoes the effect that a
+// particular block had on the wallet's internal Utxo state.
+func (m *InMemoryWallet) UnwindBlock(headerBytes []byte) {
+	header := m.ReadBlockHeader(headerBytes)
+	//var hdr wire.BlockHeader
+	//if err := hdr.FromBytes(header); err != nil {
+	//	panic(err)
+	//}
+	//height := int64(hdr.Height)
+	height := header.Height()
+
+	m.pushChainUpdate(&chainUpdate{
+		updateType:  blockDisconnected,
+		blockHeight: height,
+		blockHash:   header.Hash(),
+	})
+}
+
+// OnReorganization is a call-back which is to be executed when the node
+// begins reorganizing the chain. The wallet is not considered synced until
+// the new best chain is connected up to the newHeight.
+func (m *InMemoryWallet) OnReorganization(oldHash Hash, oldHeight int32, newHash Hash, newHeight int32) {
+	m.pushChainUpdate(&chainUpdate{
+		updateType:  chainReorganized,
+		blockHeight: int64(newHeight),
+		blockHash:   newHash,
+	})
+}
+
+// pushChainUpdate appends the new chain update to the end of the queue
+// processed by the chainSyncer. Block connects, disconnects and
+// reorganizations share the queue, so they are applied in the order
+// the node reported them.
+func (m *InMemoryWallet) pushChainUpdate(update *chainUpdate) {
 	m.chainMtx.Lock()
-	m.chainUpdates = append(m.chainUpdates, &chainUpdate{height, txns})
+	m.chainUpdates = append(m.chainUpdates, update)
 	m.chainMtx.Unlock()
 
 	// Launch a goroutine to signal the chainSyncer that a new update is
@@ -242,83 +470,149 @@ func (m *InMemoryWallet) IngestBlock(headerBytes []byte, filteredTxns [][]byte)
 	}()
 }
 
-//// ingestBlock updates the wallet's internal Utxo state based on the outputs
-//// created and destroyed within each block.
-//func (wallet *InMemoryWallet) ingestBlock(update *chainUpdate) {
-//	// Update the latest synced height, then process each filtered
-//	// transaction in the block creating and destroying Utxos within
-//	// the wallet as a result.
-//	wallet.currentHeight = update.blockHeight
-//	undo := &UndoEntry{
-//		utxosDestroyed: make(map[coinharness.OutPoint]*Utxo),
-//	}
-//	for _, tx := range update.filteredTxns {
-//		mtx := tx.MsgTx()
-//		isCoinbase := blockchain.IsCoinBaseTx(mtx)
-//		txHash := mtx.TxHash()
-//		wallet.evalOutputs(mtx.TxOut, &txHash, isCoinbase, undo)
-//		wallet.evalInputs(mtx.TxIn, undo)
-//	}
-//
-//	// Finally, record the undo entry for this block so we can
-//	// properly update our internal state in response to the block
-//	// being re-org'd from the main chain.
-//	wallet.ReorgJournal[update.blockHeight] = undo
-//}
-
 // chainSyncer is a goroutine dedicated to processing new blocks in order to
-// keep the wallet's Utxo state up to date.
+// keep the wallet's Utxo state up to date. On the stopSignal the updates left
+// in the queue are processed and the done channel is closed.
 //
 // NOTE: This MUST be run as a goroutine.
-func (wallet *InMemoryWallet) chainSyncer() {
-	var update *chainUpdate
+func (wallet *InMemoryWallet) chainSyncer(done chan struct{}) {
+	defer close(done)
 
 	for s := range wallet.ChainUpdateSignal {
 		if s == stopSignal {
-			break
-		}
-		// A new update is available, so pop the new chain update from
-		// the front of the update queue.
-		wallet.chainMtx.Lock()
-		update = wallet.chainUpdates[0]
-		wallet.chainUpdates[0] = nil // Set to nil to prevent GC leak.
-		wallet.chainUpdates = wallet.chainUpdates[1:]
+			for wallet.applyNextChainUpdate() {
+			}
+			return
+		}
+		// A new update is available, signals of the updates
+		// processed on the previous stop find the queue empty.
+		wallet.applyNextChainUpdate()
+	}
+}
+
+// applyNextChainUpdate pops the chain update from the front of the update
+// queue and applies it. Returns false when the queue is empty.
+func (wallet *InMemoryWallet) applyNextChainUpdate() bool {
+	wallet.chainMtx.Lock()
+	if len(wallet.chainUpdates) == 0 {
 		wallet.chainMtx.Unlock()
+		return false
+	}
+	update := wallet.chainUpdates[0]
+	wallet.chainUpdates[0] = nil // Set to nil to prevent GC leak.
+	wallet.chainUpdates = wallet.chainUpdates[1:]
+	wallet.chainMtx.Unlock()
+
+	wallet.Lock()
+	wallet.applyChainUpdate(update)
+	wallet.Unlock()
+
+	// Block connects expire and evict unmined transactions,
+	// disconnects return them to the node mempool or drop them.
+	wallet.refreshMempool()
+	return true
+}
+
+// applyChainUpdate updates the wallet state with the chain update
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) applyChainUpdate(update *chainUpdate) {
+	switch update.updateType {
+	case blockConnected:
+		wallet.ingestBlock(update)
+	case blockDisconnected:
+		wallet.unwindBlock(update)
+	case chainReorganized:
+		wallet.reorgHeight = update.blockHeight
+		wallet.reorgHash = update.blockHash
+	case updatesApplied:
+		close(update.done)
+	}
+}
 
-		// Update the latest synced height, then process each filtered
-		// transaction in the block creating and destroying Utxos within
-		// the wallet as a result.
-		wallet.Lock()
+// ingestBlock updates the wallet's internal Utxo state based on the outputs
+// created and destroyed within each block.
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) ingestBlock(update *chainUpdate) {
+	// A rescan of the older blocks keeps the synced height and must not
+	// bring back outputs spent by the blocks ingested later.
+	rescan := update.blockHeight <= wallet.currentHeight
+	var spentLater map[OutPoint]bool
+	if rescan {
+		spentLater = wallet.spentAfter(update.blockHeight)
+	} else {
 		wallet.currentHeight = update.blockHeight
-		undo := &UndoEntry{
-			utxosDestroyed: make(map[OutPoint]*Utxo),
-		}
-		for _, tx := range update.filteredTxns {
-			mtx := tx.MsgTx
-			isCoinbase := wallet.IsCoinBaseTx(mtx)
-			txHash := mtx.TxHash()
-			wallet.evalOutputs(mtx.TxOut, txHash, isCoinbase, undo)
-			wallet.evalInputs(mtx.TxIn, undo)
-		}
+		wallet.currentHash = update.blockHash
+	}
 
-		// Finally, record the undo entry for this block so we can
-		// properly update our internal state in response to the block
-		// being re-org'd from the main chain.
+	// Process each filtered transaction in the block creating and
+	// destroying Utxos within the wallet as a result.
+	undo := &UndoEntry{
+		blockHash:      update.blockHash,
+		utxosDestroyed: make(map[OutPoint]*Utxo),
+	}
+	for _, tx := range update.filteredTxns {
+		mtx := tx.MsgTx
+		isCoinbase := wallet.IsCoinBaseTx(mtx)
+		txHash := mtx.TxHash()
+		wallet.evalOutputs(mtx.TxOut, txHash, update.blockHeight, isCoinbase, undo, spentLater)
+		wallet.evalInputs(mtx.TxIn, undo)
+	}
+	wallet.reconcileMempool(update.filteredTxns)
+
+	// Finally, record the undo entry for this block so we can
+	// properly update our internal state in response to the block
+	// being re-org'd from the main chain. The entry of a rescanned
+	// block is extended with the newly found changes.
+	if prev, ok := wallet.ReorgJournal[update.blockHeight]; ok && rescan {
+		prev.utxosCreated = append(prev.utxosCreated, undo.utxosCreated...)
+		for op, utxo := range undo.utxosDestroyed {
+			prev.utxosDestroyed[op] = utxo
+		}
+	} else {
 		wallet.ReorgJournal[update.blockHeight] = undo
-		wallet.Unlock()
+	}
+
+	// The new best chain is fully connected
+	if wallet.currentHeight >= wallet.reorgHeight {
+		wallet.reorgHeight = 0
+		wallet.reorgHash = nil
 	}
 }
 
+// spentAfter returns wallet outputs destroyed by the blocks
+// above the height
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) spentAfter(height int64) map[OutPoint]bool {
+	spent := make(map[OutPoint]bool)
+	for undoHeight, undo := range wallet.ReorgJournal {
+		if undoHeight <= height {
+			continue
+		}
+		for op := range undo.utxosDestroyed {
+			spent[op] = true
+		}
+	}
+	return spent
+}
+
 // evalOutputs evaluates each of the passed outputs, creating a new matching
-// Utxo within the wallet if we're able to spend the output.
-func (wallet *InMemoryWallet) evalOutputs(outputs []*TxOut, txHash Hash, isCoinbase bool, undo *UndoEntry) {
+// Utxo within the wallet if we're able to spend the output. Outputs already
+// known to the wallet or listed in the spent set are skipped.
+func (wallet *InMemoryWallet) evalOutputs(outputs []*TxOut, txHash Hash, blockHeight int64, isCoinbase bool, undo *UndoEntry, spent map[OutPoint]bool) {
 	for i, output := range outputs {
 		pkScript := output.PkScript
+		op := OutPoint{Hash: txHash, Index: uint32(i)}
+		if _, ok := wallet.Utxos[op]; ok || spent[op] {
+			continue
+		}
 
 		// Scan all the addresses we currently control to see if the
 		// output is paying to us.
-		for keyIndex, addr := range wallet.Addrs {
-			pkHash := addr.ScriptAddress()
+		for _, owned := range wallet.addresses() {
+			pkHash := owned.addr.ScriptAddress()
 			if !bytes.Contains(pkScript, pkHash) {
 				continue
 			}
@@ -328,13 +622,14 @@ func (wallet *InMemoryWallet) evalOutputs(outputs []*TxOut, txHash Hash, isCoinb
 			// future.
 			var maturityHeight int64
 			if isCoinbase {
-				maturityHeight = wallet.currentHeight + int64(wallet.Net.CoinbaseMaturity())
+				maturityHeight = blockHeight + int64(wallet.Net.CoinbaseMaturity())
 			}
 
-			op := OutPoint{Hash: txHash, Index: uint32(i)}
 			wallet.Utxos[op] = &Utxo{
 				value:          output.Value.Copy(),
-				keyIndex:       keyIndex,
+				account:        owned.account,
+				keyIndex:       owned.keyIndex,
+				blockHeight:    blockHeight,
 				maturityHeight: maturityHeight,
 				pkScript:       pkScript,
 			}
@@ -358,56 +653,57 @@ func (wallet *InMemoryWallet) evalInputs(inputs []*TxIn, undo *UndoEntry) {
 	}
 }
 
-// UnwindBlock is a call-back which is to be executed each time a block is
-// disconnected from the main chain. Unwinding a block undoes the effect that a
-// particular block had on the wallet's internal Utxo state.
-func (m *InMemoryWallet) UnwindBlock(headerBytes []byte) {
-	header := m.ReadBlockHeader(headerBytes)
-	//var hdr wire.BlockHeader
-	//if err := hdr.FromBytes(header); err != nil {
-	//	panic(err)
-	//}
-	//height := int64(hdr.Height)
-	height := header.Height()
-	m.Lock()
-	defer m.Unlock()
-
-	undo := m.ReorgJournal[height]
-
-	for _, utxo := range undo.utxosCreated {
-		delete(m.Utxos, utxo)
-	}
-
-	for outPoint, utxo := range undo.utxosDestroyed {
-		m.Utxos[outPoint] = utxo
-	}
-
-	delete(m.ReorgJournal, height)
-}
-
 // unwindBlock undoes the effect that a particular block had on the wallet's
-// internal Utxo state.
+// internal Utxo state and rolls the wallet back to the previous block.
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
 func (wallet *InMemoryWallet) unwindBlock(update *chainUpdate) {
-	undo := wallet.ReorgJournal[update.blockHeight]
+	if undo, ok := wallet.ReorgJournal[update.blockHeight]; ok {
+		for _, utxo := range undo.utxosCreated {
+			delete(wallet.Utxos, utxo)
+		}
+
+		for outPoint, utxo := range undo.utxosDestroyed {
+			wallet.Utxos[outPoint] = utxo
+		}
 
-	for _, utxo := range undo.utxosCreated {
-		delete(wallet.Utxos, utxo)
+		delete(wallet.ReorgJournal, update.blockHeight)
 	}
 
-	for outPoint, utxo := range undo.utxosDestroyed {
-		wallet.Utxos[outPoint] = utxo
+	wallet.currentHeight = update.blockHeight - 1
+	wallet.currentHash = nil
+	if prev, ok := wallet.ReorgJournal[wallet.currentHeight]; ok {
+		wallet.currentHash = prev.blockHash
 	}
 
-	delete(wallet.ReorgJournal, update.blockHeight)
+	// The new best chain tip is lower than the old one and is reached
+	// by disconnecting blocks only, e.g. after the invalidateblock.
+	// Passing the reorg height on the way down to a lower fork point
+	// does not count, unless the tip hash is unknown.
+	if wallet.reorgHeight != 0 && wallet.currentHeight == wallet.reorgHeight {
+		if wallet.currentHash == nil || wallet.reorgHash == nil ||
+			hashToString(wallet.currentHash) == hashToString(wallet.reorgHash) {
+			wallet.reorgHeight = 0
+			wallet.reorgHash = nil
+		}
+	}
 }
 
-// newAddress returns a new address from the wallet's hd key chain.  It also
+// newAddress returns a new address from the account hd key chain.  It also
 // loads the address into the RPC client's transaction filter to ensure any
 // transactions that involve it are delivered via the notifications.
-func (wallet *InMemoryWallet) newAddress() (Address, error) {
-	index := wallet.HdIndex
+func (wallet *InMemoryWallet) newAddress(accountName string) (Address, error) {
+	addrs, err := wallet.accountAddrs(accountName)
+	if err != nil {
+		return nil, err
+	}
+	hdIndex := &wallet.HdIndex
+	if accountName != DefaultAccountName {
+		hdIndex = &wallet.accounts[accountName].hdIndex
+	}
+	index := *hdIndex
 
-	childKey, err := wallet.HdRoot.Child(index)
+	childKey, err := wallet.accountKey(accountName, index)
 	if err != nil {
 		return nil, err
 	}
@@ -426,21 +722,21 @@ func (wallet *InMemoryWallet) newAddress() (Address, error) {
 		return nil, err
 	}
 
-	wallet.Addrs[index] = addr
+	addrs[index] = addr
 
-	wallet.HdIndex++
+	*hdIndex++
 
 	return addr, nil
 }
 
-// NewAddress returns a fresh address spendable by the wallet.
+// NewAddress returns a fresh address of the account spendable by the wallet.
 //
 // This function is safe for concurrent access.
 func (wallet *InMemoryWallet) NewAddress(account string) (Address, error) {
 	wallet.Lock()
 	defer wallet.Unlock()
 
-	add, err := wallet.newAddress()
+	add, err := wallet.newAddress(account)
 
 	if err != nil {
 		return nil, err
@@ -449,11 +745,126 @@ func (wallet *InMemoryWallet) NewAddress(account string) (Address, error) {
 	return add, nil
 }
 
+// ListUnspent returns the set of Utxos currently tracked by the wallet.
+//
+// This function is safe for concurrent access.
 func (wallet *InMemoryWallet) ListUnspent() (result []*Unspent, err error) {
+	wallet.RLock()
+	defer wallet.RUnlock()
+
+	result = make([]*Unspent, 0, len(wallet.Utxos)+len(wallet.mempool.utxos))
+	for op, utxo := range wallet.Utxos {
+		// Already spent by an unmined transaction
+		if _, ok := wallet.mempool.spent[op]; ok {
+			continue
+		}
+		result = append(result, wallet.newUnspent(op, utxo))
+	}
+	for op, utxo := range wallet.mempool.utxos {
+		if _, ok := wallet.mempool.spent[op]; ok {
+			continue
+		}
+		unspent := wallet.newUnspent(op, utxo)
+		unspent.Confirmations = 0
+		unspent.Spendable = !utxo.isLocked
+		result = append(result, unspent)
+	}
+	return result, nil
+}
+
+// newUnspent describes the wallet Utxo as an Unspent.
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) newUnspent(op OutPoint, utxo *Utxo) *Unspent {
+	unspent := &Unspent{
+		TxID:          hashToString(op.Hash),
+		Vout:          op.Index,
+		Tree:          op.Tree,
+		Account:       utxo.account,
+		ScriptPubKey:  hex.EncodeToString(utxo.pkScript),
+		Amount:        utxo.value.Copy(),
+		Confirmations: wallet.currentHeight - utxo.blockHeight + 1,
+		Spendable:     utxo.isMature(wallet.currentHeight) && !utxo.isLocked,
+	}
+	if addrs, err := wallet.accountAddrs(utxo.account); err == nil {
+		if addr, ok := addrs[utxo.keyIndex]; ok {
+			unspent.Address = addr.String()
+		}
+	}
+	return unspent
+}
+
+// SignTx signs each input of the tx with the private key derived from
+// the HdRoot for the address owning the spent output.
+// Implements TxSigner.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) SignTx(tx *MessageTx, spent []*Unspent) error {
+	if wallet.SignatureScript == nil {
+		return fmt.Errorf("InMemoryWallet.SignatureScript is not set")
+	}
+	if len(spent) != len(tx.TxIn) {
+		return fmt.Errorf("tx has %v inputs, %v spent outputs provided",
+			len(tx.TxIn), len(spent))
+	}
+
+	wallet.RLock()
+	defer wallet.RUnlock()
+
+	for i, output := range spent {
+		owned, ok := wallet.lookupAddress(output.Address)
+		if !ok {
+			return fmt.Errorf("address %v does not belong to the wallet",
+				output.Address)
+		}
+		childKey, err := wallet.accountKey(owned.account, owned.keyIndex)
+		if err != nil {
+			return err
+		}
+		privKey, err := childKey.PrivateKey()
+		if err != nil {
+			return err
+		}
+		pkScript, err := hex.DecodeString(output.ScriptPubKey)
+		if err != nil {
+			return err
+		}
+		sigScript, err := wallet.SignatureScript(tx, i, pkScript, privKey)
+		if err != nil {
+			return err
+		}
+		tx.TxIn[i].SignatureScript = sigScript
+	}
+	return nil
+}
+
+// LockOutputs locks the outputs spent by the inputs, so they are not
+// selected again by the CreateTransaction method. Nothing is locked when
+// any of the outputs is already locked.
+// Implements OutputsLocker.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) LockOutputs(inputs []TxIn) error {
 	wallet.Lock()
 	defer wallet.Unlock()
 
-	panic("not implemented")
+	for _, input := range inputs {
+		utxo, ok := wallet.lookupUtxo(input.PreviousOutPoint)
+		if !ok {
+			return fmt.Errorf("output %v:%v is not tracked by the wallet",
+				input.PreviousOutPoint.Hash, input.PreviousOutPoint.Index)
+		}
+		if utxo.isLocked {
+			return ErrOutputsLocked
+		}
+	}
+
+	for _, input := range inputs {
+		utxo, _ := wallet.lookupUtxo(input.PreviousOutPoint)
+		utxo.isLocked = true
+	}
+
+	return nil
 }
 
 // UnlockOutputs unlocks any outputs which were previously locked due to
@@ -465,7 +876,7 @@ func (wallet *InMemoryWallet) UnlockOutputs(inputs []TxIn) error {
 	defer wallet.Unlock()
 
 	for _, input := range inputs {
-		utxo, ok := wallet.Utxos[input.PreviousOutPoint]
+		utxo, ok := wallet.lookupUtxo(input.PreviousOutPoint)
 		if !ok {
 			continue
 		}
@@ -476,7 +887,7 @@ func (wallet *InMemoryWallet) UnlockOutputs(inputs []TxIn) error {
 	return nil
 }
 
-// GetBalance returns the confirmed balance of the wallet.
+// GetBalance returns the balance of each wallet account at the synced tip.
 //
 // This function is safe for concurrent access.
 func (wallet *InMemoryWallet) GetBalance() (*GetBalanceResult, error) {
@@ -484,23 +895,45 @@ func (wallet *InMemoryWallet) GetBalance() (*GetBalanceResult, error) {
 	defer wallet.RUnlock()
 	result := &GetBalanceResult{}
 	result.Balances = make(map[string]GetAccountBalanceResult)
-	//result.BlockHash
-	b := GetAccountBalanceResult{}
-	result.Balances[DefaultAccountName] = b
+	result.BlockHash = wallet.currentHash
+
+	balances := make(map[string]*GetAccountBalanceResult)
+	for _, name := range wallet.accountNames() {
+		balances[name] = &GetAccountBalanceResult{AccountName: name}
+	}
+
+	for op, utxo := range wallet.Utxos {
+		// Already spent by an unmined transaction
+		if _, ok := wallet.mempool.spent[op]; ok {
+			continue
+		}
+		b := balances[utxo.account]
+		b.Total.AtomsValue += utxo.value.AtomsValue
 
-	balance := coin.Amount{0}
-	for _, utxo := range wallet.Utxos {
 		// Prevent any immature or locked outputs from contributing to
-		// the wallet's total confirmed balance.
-		if !utxo.isMature(wallet.currentHeight) || utxo.isLocked {
+		// the wallet's spendable balance.
+		if !utxo.isMature(wallet.currentHeight) {
+			b.ImmatureCoinbaseRewards.AtomsValue += utxo.value.AtomsValue
+			continue
+		}
+		if utxo.isLocked {
 			continue
 		}
+		b.Spendable.AtomsValue += utxo.value.AtomsValue
+	}
 
-		balance.AtomsValue += utxo.value.AtomsValue
+	for op, utxo := range wallet.mempool.utxos {
+		if _, ok := wallet.mempool.spent[op]; ok {
+			continue
+		}
+		b := balances[utxo.account]
+		b.Total.AtomsValue += utxo.value.AtomsValue
+		b.Unconfirmed.AtomsValue += utxo.value.AtomsValue
 	}
 
-	b.Spendable = balance
-	b.AccountName = DefaultAccountName
+	for name, b := range balances {
+		result.Balances[name] = *b
+	}
 	return result, nil
 }
 
@@ -508,17 +941,6 @@ func (wallet *InMemoryWallet) RPCClient() *RPCConnection {
 	panic("Method not supported")
 }
 
-func (wallet *InMemoryWallet) CreateNewAccount(accountName string) error {
-	panic("")
-}
-
-func (wallet *InMemoryWallet) GetNewAddress(accountName string) (Address, error) {
-	panic("")
-}
-func (wallet *InMemoryWallet) ValidateAddress(address Address) (*ValidateAddressResult, error) {
-	panic("")
-}
-
 func (wallet *InMemoryWallet) WalletUnlock(password string, seconds int64) error {
 	return nil
 }
@@ -0,0 +1,500 @@
+package coinharness
+
+import (
+	"context"
+	"fmt"
+	"github.com/jfixby/coin"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+// testHash is a comparable Hash used by tests
+type testHash string
+
+func (h testHash) String() string {
+	return string(h)
+}
+
+func blockHashAt(height int64) Hash {
+	return testHash(fmt.Sprintf("block-%v", height))
+}
+
+// newTestMemWallet returns an InMemoryWallet processing chain updates
+// without a node connection
+func newTestMemWallet(t *testing.T) *InMemoryWallet {
+	wallet := &InMemoryWallet{
+		Addrs:             make(map[uint32]Address),
+		Utxos:             make(map[OutPoint]*Utxo),
+		ReorgJournal:      make(map[int64]*UndoEntry),
+		ChainUpdateSignal: make(chan string),
+		IsCoinBaseTx:      func(*MessageTx) bool { return false },
+		Net:               &fakeNetwork{},
+		mempool:           newMempoolState(),
+	}
+	wallet.syncerDone = make(chan struct{})
+	go wallet.chainSyncer(wallet.syncerDone)
+	t.Cleanup(func() { wallet.ChainUpdateSignal <- stopSignal })
+	return wallet
+}
+
+func connectTestBlocks(wallet *InMemoryWallet, from int64, to int64) {
+	for height := from; height <= to; height++ {
+		wallet.pushChainUpdate(&chainUpdate{
+			updateType:  blockConnected,
+			blockHeight: height,
+			blockHash:   blockHashAt(height),
+		})
+	}
+}
+
+func syncTestWallet(t *testing.T, wallet *InMemoryWallet, height int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := wallet.Sync(ctx, height, nil); err != nil {
+		t.Fatalf("wallet sync failed: %v", err)
+	}
+}
+
+func TestMemWalletDisconnectOnlyReorg(t *testing.T) {
+	wallet := newTestMemWallet(t)
+	connectTestBlocks(wallet, 1, 10)
+	syncTestWallet(t, wallet, 10)
+
+	// The node invalidates blocks 9 and 10,
+	// the new tip is the old block 8
+	wallet.OnReorganization(blockHashAt(10), 10, blockHashAt(8), 8)
+	for height := int64(10); height > 8; height-- {
+		wallet.pushChainUpdate(&chainUpdate{
+			updateType:  blockDisconnected,
+			blockHeight: height,
+			blockHash:   blockHashAt(height),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for wallet.SyncedHeight() != 8 {
+		if ctx.Err() != nil {
+			t.Fatalf("wallet did not unwind to 8, height %v", wallet.SyncedHeight())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	syncTestWallet(t, wallet, 8)
+	if wallet.isReorganizing() {
+		t.Fatal("wallet is still reorganizing")
+	}
+}
+
+func TestMemWalletReorgPassingTargetHeightOnUnwind(t *testing.T) {
+	wallet := newTestMemWallet(t)
+	connectTestBlocks(wallet, 1, 10)
+	syncTestWallet(t, wallet, 10)
+
+	// The new chain forks at 7 and its tip is at 9
+	wallet.OnReorganization(blockHashAt(10), 10, testHash("side-9"), 9)
+	for height := int64(10); height > 7; height-- {
+		wallet.pushChainUpdate(&chainUpdate{
+			updateType:  blockDisconnected,
+			blockHeight: height,
+			blockHash:   blockHashAt(height),
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for wallet.SyncedHeight() != 7 {
+		if ctx.Err() != nil {
+			t.Fatalf("wallet did not unwind to 7, height %v", wallet.SyncedHeight())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !wallet.isReorganizing() {
+		t.Fatal("reorganization finished before the new chain is connected")
+	}
+
+	for height := int64(8); height <= 9; height++ {
+		wallet.pushChainUpdate(&chainUpdate{
+			updateType:  blockConnected,
+			blockHeight: height,
+			blockHash:   testHash(fmt.Sprintf("side-%v", height)),
+		})
+	}
+	syncTestWallet(t, wallet, 9)
+}
+
+// testAddress pays to the pkScripts containing its name
+type testAddress string
+
+func (a testAddress) String() string {
+	return string(a)
+}
+
+func (a testAddress) IsForNet(network Network) bool {
+	return true
+}
+
+func (a testAddress) Internal() interface{} {
+	return nil
+}
+
+func (a testAddress) ScriptAddress() []byte {
+	return []byte(a)
+}
+
+func newTestTx(hash string, spends []OutPoint, payTo ...string) *Tx {
+	mtx := &MessageTx{
+		TxHash: func() Hash { return testHash(hash) },
+	}
+	for _, op := range spends {
+		mtx.TxIn = append(mtx.TxIn, &TxIn{PreviousOutPoint: op})
+	}
+	for _, addr := range payTo {
+		mtx.TxOut = append(mtx.TxOut, &TxOut{
+			PkScript: []byte("script-" + addr),
+			Value:    coin.Amount{AtomsValue: 1000},
+		})
+	}
+	return &Tx{Hash: testHash(hash), MsgTx: mtx}
+}
+
+func TestMemWalletRescanAfterSpend(t *testing.T) {
+	wallet := &InMemoryWallet{
+		Addrs:        map[uint32]Address{0: testAddress("mine")},
+		Utxos:        make(map[OutPoint]*Utxo),
+		ReorgJournal: make(map[int64]*UndoEntry),
+		IsCoinBaseTx: func(*MessageTx) bool { return false },
+		Net:          &fakeNetwork{},
+		mempool:      newMempoolState(),
+	}
+
+	received := OutPoint{Hash: testHash("tx-a"), Index: 0}
+	blocks := []*chainUpdate{
+		{
+			updateType:   blockConnected,
+			blockHeight:  1,
+			blockHash:    blockHashAt(1),
+			filteredTxns: []*Tx{newTestTx("tx-a", nil, "mine")},
+		},
+		{
+			updateType:   blockConnected,
+			blockHeight:  2,
+			blockHash:    blockHashAt(2),
+			filteredTxns: []*Tx{newTestTx("tx-b", []OutPoint{received}, "other")},
+		},
+	}
+	for _, block := range blocks {
+		wallet.applyChainUpdate(block)
+	}
+	if _, ok := wallet.Utxos[received]; ok {
+		t.Fatal("spent output is not removed")
+	}
+
+	// Rescan the block 1 only, the spending block 2 is not rescanned
+	wallet.applyChainUpdate(blocks[0])
+	if _, ok := wallet.Utxos[received]; ok {
+		t.Fatal("output spent at height 2 is back after the rescan")
+	}
+	if wallet.SyncedHeight() != 2 {
+		t.Fatalf("rescan moved the synced height to %v", wallet.SyncedHeight())
+	}
+	if n := len(wallet.ReorgJournal[1].utxosCreated); n != 1 {
+		t.Fatalf("undo entry of the block 1 has %v created outputs, expected 1", n)
+	}
+	if _, ok := wallet.ReorgJournal[2].utxosDestroyed[received]; !ok {
+		t.Fatal("undo entry of the block 2 has lost the spent output")
+	}
+
+	// Unwinding the spend brings the output back,
+	// unwinding the block 1 removes it
+	wallet.applyChainUpdate(&chainUpdate{updateType: blockDisconnected, blockHeight: 2})
+	if _, ok := wallet.Utxos[received]; !ok {
+		t.Fatal("output is not restored after unwinding the spend")
+	}
+	wallet.applyChainUpdate(&chainUpdate{updateType: blockDisconnected, blockHeight: 1})
+	if _, ok := wallet.Utxos[received]; ok {
+		t.Fatal("output is left after unwinding the block 1")
+	}
+}
+
+func TestMemWalletStopProcessesQueuedUpdates(t *testing.T) {
+	wallet := &InMemoryWallet{
+		Addrs:             make(map[uint32]Address),
+		Utxos:             make(map[OutPoint]*Utxo),
+		ReorgJournal:      make(map[int64]*UndoEntry),
+		ChainUpdateSignal: make(chan string),
+		IsCoinBaseTx:      func(*MessageTx) bool { return false },
+		Net:               &fakeNetwork{},
+		WorkingDir:        t.TempDir(),
+		mempool:           newMempoolState(),
+		nodeRPC:           &fakeRPCClient{},
+		syncerDone:        make(chan struct{}),
+	}
+	go wallet.chainSyncer(wallet.syncerDone)
+
+	connectTestBlocks(wallet, 1, 50)
+	if err := wallet.Stop(); err != nil {
+		t.Fatalf("unable to stop wallet: %v", err)
+	}
+	if height := wallet.SyncedHeight(); height != 50 {
+		t.Fatalf("wallet stopped at height %v, expected 50", height)
+	}
+
+	saved := &InMemoryWallet{NewHashFromStr: func(s string) (Hash, error) { return testHash(s), nil }}
+	if err := saved.Load(wallet.StateFile()); err != nil {
+		t.Fatalf("unable to load wallet state: %v", err)
+	}
+	if saved.currentHeight != 50 {
+		t.Fatalf("saved height %v, expected 50", saved.currentHeight)
+	}
+}
+
+// mempoolRPCClient reports the node mempool
+type mempoolRPCClient struct {
+	fakeRPCClient
+	mempool []Hash
+}
+
+func (c *mempoolRPCClient) GetRawMempool(command interface{}) ([]Hash, error) {
+	return c.mempool, nil
+}
+
+func TestMemWalletRefreshMempool(t *testing.T) {
+	wallet := &InMemoryWallet{
+		Utxos:   make(map[OutPoint]*Utxo),
+		mempool: newMempoolState(),
+	}
+	funding := OutPoint{Hash: testHash("funding"), Index: 0}
+	wallet.Utxos[funding] = &Utxo{value: coin.Amount{AtomsValue: 1000}}
+	received := OutPoint{Hash: testHash("tx-a"), Index: 0}
+
+	// tx-a spends the funding output, tx-b spends the tx-a output
+	for _, tx := range []*Tx{
+		newTestTx("tx-a", []OutPoint{funding}, "mine"),
+		newTestTx("tx-b", []OutPoint{received}, "other"),
+	} {
+		wallet.mempool.txs[tx.Hash] = tx.MsgTx
+		wallet.mempool.spent[tx.MsgTx.TxIn[0].PreviousOutPoint] = tx.Hash
+	}
+	wallet.mempool.utxos[received] = &Utxo{value: coin.Amount{AtomsValue: 1000}}
+
+	// The node keeps both transactions
+	node := &mempoolRPCClient{mempool: []Hash{testHash("tx-b"), testHash("tx-a")}}
+	wallet.nodeRPC = node
+	wallet.refreshMempool()
+	if len(wallet.mempool.txs) != 2 {
+		t.Fatalf("%v unmined transactions are tracked, expected 2", len(wallet.mempool.txs))
+	}
+
+	// The node has evicted tx-a and its descendant
+	node.mempool = nil
+	wallet.refreshMempool()
+	if len(wallet.mempool.txs) != 0 || len(wallet.mempool.utxos) != 0 {
+		t.Fatalf("evicted transactions are still tracked: %v", wallet.mempool.txs)
+	}
+	if _, ok := wallet.mempool.spent[funding]; ok {
+		t.Fatal("output spent by the evicted transaction is still hidden")
+	}
+}
+
+// testKey derives the keys named by their derivation path
+type testKey string
+
+func (k testKey) Child(u uint32) (ExtendedKey, error) {
+	return testKey(fmt.Sprintf("%v/%v", k, u)), nil
+}
+
+func (k testKey) PrivateKey() (PrivateKey, error) {
+	return testPrivateKey(k), nil
+}
+
+type testPrivateKey string
+
+func (k testPrivateKey) PublicKey() PublicKey {
+	return nil
+}
+
+func testKeyToAddr(key PrivateKey, net Network) (Address, error) {
+	return testAddress(key.(testPrivateKey)), nil
+}
+
+// fakeChainRPCClient serves the chain of the blocks, the block at index i
+// is at height i. Blocks above the non-zero forkHeight are on a side chain.
+type fakeChainRPCClient struct {
+	fakeRPCClient
+	blocks     []*MsgBlock
+	forkHeight int64
+}
+
+func (c *fakeChainRPCClient) GetBlockHash(blockHeight int64) (Hash, error) {
+	if blockHeight < 0 || blockHeight >= int64(len(c.blocks)) {
+		return nil, fmt.Errorf("no block at height %v", blockHeight)
+	}
+	if c.forkHeight != 0 && blockHeight > c.forkHeight {
+		return testHash(fmt.Sprintf("side-%v", blockHeight)), nil
+	}
+	return blockHashAt(blockHeight), nil
+}
+
+func (c *fakeChainRPCClient) GetBlock(hash Hash) (*MsgBlock, error) {
+	for height, block := range c.blocks {
+		if blockHash, _ := c.GetBlockHash(int64(height)); blockHash == hash {
+			return block, nil
+		}
+	}
+	return nil, fmt.Errorf("block %v not found", hash)
+}
+
+func (c *fakeChainRPCClient) GetBestBlock() (Hash, int64, error) {
+	height := int64(len(c.blocks) - 1)
+	hash, err := c.GetBlockHash(height)
+	return hash, height, err
+}
+
+// fakeChainRPCClientFactory connects to the node client
+type fakeChainRPCClientFactory struct {
+	node *fakeChainRPCClient
+}
+
+func (f *fakeChainRPCClientFactory) NewRPCConnection(config RPCConnectionConfig, handlers *NotificationHandlers) (RPCClient, error) {
+	return f.node, nil
+}
+
+func (c *fakeChainRPCClient) LoadTxFilter(b bool, addresses []Address) error {
+	return nil
+}
+
+// newTestChain returns blocks up to the height,
+// payments maps heights to the addresses paid by the block
+func newTestChain(height int64, payments map[int64]string) []*MsgBlock {
+	blocks := []*MsgBlock{}
+	for h := int64(0); h <= height; h++ {
+		block := &MsgBlock{}
+		if addr, ok := payments[h]; ok {
+			tx := newTestTx(fmt.Sprintf("pay-%v", h), nil, addr)
+			block.Transactions = append(block.Transactions, tx.MsgTx)
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+// newTestChainUpdate connects the chain block at the height
+func newTestChainUpdate(chain []*MsgBlock, height int64) *chainUpdate {
+	update := &chainUpdate{
+		updateType:  blockConnected,
+		blockHeight: height,
+		blockHash:   blockHashAt(height),
+	}
+	for _, mtx := range chain[height].Transactions {
+		update.filteredTxns = append(update.filteredTxns, &Tx{Hash: mtx.TxHash(), MsgTx: mtx})
+	}
+	return update
+}
+
+func TestMemWalletRescanReturnsWhenApplied(t *testing.T) {
+	wallet := newTestMemWallet(t)
+	wallet.HdRoot = testKey("root")
+	wallet.PrivateKeyKeyToAddr = testKeyToAddr
+	wallet.nodeRPC = &fakeChainRPCClient{
+		blocks: newTestChain(10, map[int64]string{2: "root/0"}),
+	}
+	connectTestBlocks(wallet, 1, 10)
+	syncTestWallet(t, wallet, 10)
+
+	// A partial rescan of the already synced blocks
+	if err := wallet.Rescan(1, 3); err != nil {
+		t.Fatalf("rescan failed: %v", err)
+	}
+	wallet.RLock()
+	defer wallet.RUnlock()
+	if len(wallet.Utxos) != 1 {
+		t.Fatalf("wallet has %v outputs after the rescan, expected 1", len(wallet.Utxos))
+	}
+}
+
+func newTestStateWallet(workingDir string) *InMemoryWallet {
+	return &InMemoryWallet{
+		HdRoot:              testKey("root"),
+		PrivateKeyKeyToAddr: testKeyToAddr,
+		Addrs:               make(map[uint32]Address),
+		Utxos:               make(map[OutPoint]*Utxo),
+		ReorgJournal:        make(map[int64]*UndoEntry),
+		ChainUpdateSignal:   make(chan string),
+		IsCoinBaseTx:        func(*MessageTx) bool { return false },
+		NewHashFromStr:      func(s string) (Hash, error) { return testHash(s), nil },
+		Net:                 &fakeNetwork{},
+		WorkingDir:          workingDir,
+		mempool:             newMempoolState(),
+	}
+}
+
+func TestMemWalletStartCatchesUpWithNodeChain(t *testing.T) {
+	dir := t.TempDir()
+
+	// The saved wallet has seen the payment at the block 9
+	saved := newTestStateWallet(dir)
+	saved.Addrs[0] = testAddress("root/0")
+	saved.HdIndex = 1
+	chain := newTestChain(10, map[int64]string{9: "root/0"})
+	for height := int64(1); height <= 10; height++ {
+		saved.applyChainUpdate(newTestChainUpdate(chain, height))
+	}
+	if err := saved.Save(saved.StateFile()); err != nil {
+		t.Fatalf("unable to save wallet state: %v", err)
+	}
+
+	// While the wallet was stopped, the node has replaced the blocks
+	// above 8 and extended the new chain up to 12, paying at the block 12
+	node := &fakeChainRPCClient{
+		blocks:     newTestChain(12, map[int64]string{12: "root/0"}),
+		forkHeight: 8,
+	}
+	wallet := newTestStateWallet(dir)
+	wallet.RPCClientFactory = &fakeChainRPCClientFactory{node: node}
+	if err := wallet.Start(&TestWalletStartArgs{}); err != nil {
+		t.Fatalf("unable to start wallet: %v", err)
+	}
+	defer wallet.Stop()
+
+	if height := wallet.SyncedHeight(); height != 12 {
+		t.Fatalf("wallet is at height %v, expected 12", height)
+	}
+	wallet.RLock()
+	defer wallet.RUnlock()
+	if hashToString(wallet.currentHash) != "side-12" {
+		t.Fatalf("wallet tip is %v, expected side-12", wallet.currentHash)
+	}
+	if len(wallet.Utxos) != 1 {
+		t.Fatalf("wallet has %v outputs, expected 1", len(wallet.Utxos))
+	}
+	for op := range wallet.Utxos {
+		if hashToString(op.Hash) != "pay-12" {
+			t.Fatalf("wallet has output %v of the replaced block", op.Hash)
+		}
+	}
+}
+
+func TestMemWalletLoadRejectsUnknownAccount(t *testing.T) {
+	dir := t.TempDir()
+	saved := newTestStateWallet(dir)
+	saved.Utxos[OutPoint{Hash: testHash("tx-a")}] = &Utxo{
+		value:   coin.Amount{AtomsValue: 1000},
+		account: "ghost",
+	}
+	if err := saved.Save(saved.StateFile()); err != nil {
+		t.Fatalf("unable to save wallet state: %v", err)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("temporary files are left after save: %v", len(files))
+	}
+
+	wallet := newTestStateWallet(dir)
+	if err := wallet.Load(wallet.StateFile()); err == nil {
+		t.Fatal("state with the output of an unknown account is loaded")
+	}
+}
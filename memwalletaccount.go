@@ -0,0 +1,154 @@
+package coinharness
+
+import (
+	"fmt"
+)
+
+// accountBranchOffset is added to the account number to derive the account
+// branch key from the HdRoot. Hardened derivation keeps the account branches
+// apart from the default account keys derived directly from the HdRoot.
+const accountBranchOffset = 0x80000000
+
+// memWalletAccount is an InMemoryWallet account created by the
+// CreateNewAccount. Keys of the account are derived from its own HD branch
+// under the HdRoot.
+type memWalletAccount struct {
+	number uint32
+
+	// branch is the account master key derived from the HdRoot
+	branch ExtendedKey
+
+	// hdIndex is the next available key index offset from the branch
+	hdIndex uint32
+
+	// addrs tracks all addresses belonging to the account. The addresses
+	// are indexed by their keypath from the branch.
+	addrs map[uint32]Address
+}
+
+// walletAddress locates an address of the wallet
+type walletAddress struct {
+	account  string
+	keyIndex uint32
+	addr     Address
+}
+
+// CreateNewAccount creates a new account with its own HD branch.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) CreateNewAccount(accountName string) error {
+	wallet.Lock()
+	defer wallet.Unlock()
+
+	if _, ok := wallet.accounts[accountName]; ok || accountName == DefaultAccountName {
+		return fmt.Errorf("account %v already exists", accountName)
+	}
+	if wallet.accounts == nil {
+		wallet.accounts = make(map[string]*memWalletAccount)
+	}
+
+	number := uint32(len(wallet.accounts) + 1)
+	branch, err := wallet.HdRoot.Child(accountBranchOffset + number)
+	if err != nil {
+		return err
+	}
+	wallet.accounts[accountName] = &memWalletAccount{
+		number: number,
+		branch: branch,
+		addrs:  make(map[uint32]Address),
+	}
+	return nil
+}
+
+// GetNewAddress returns a fresh address of the account.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) GetNewAddress(accountName string) (Address, error) {
+	return wallet.NewAddress(accountName)
+}
+
+// ValidateAddress reports whether the address belongs to the wallet
+// and which account owns it.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) ValidateAddress(address Address) (*ValidateAddressResult, error) {
+	wallet.RLock()
+	defer wallet.RUnlock()
+
+	result := &ValidateAddressResult{
+		IsValid: address.IsForNet(wallet.Net),
+		Address: address.String(),
+	}
+	if owned, ok := wallet.lookupAddress(address.String()); ok {
+		result.IsMine = true
+		result.Account = owned.account
+	}
+	return result, nil
+}
+
+// accountNames lists names of all wallet accounts
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) accountNames() []string {
+	names := []string{DefaultAccountName}
+	for name := range wallet.accounts {
+		names = append(names, name)
+	}
+	return names
+}
+
+// accountAddrs returns addresses of the account indexed by their keypath
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) accountAddrs(accountName string) (map[uint32]Address, error) {
+	if accountName == DefaultAccountName {
+		return wallet.Addrs, nil
+	}
+	account, ok := wallet.accounts[accountName]
+	if !ok {
+		return nil, fmt.Errorf("account %v not found", accountName)
+	}
+	return account.addrs, nil
+}
+
+// accountKey derives the account key for the keyIndex
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) accountKey(accountName string, keyIndex uint32) (ExtendedKey, error) {
+	if accountName == DefaultAccountName {
+		return wallet.HdRoot.Child(keyIndex)
+	}
+	account, ok := wallet.accounts[accountName]
+	if !ok {
+		return nil, fmt.Errorf("account %v not found", accountName)
+	}
+	return account.branch.Child(keyIndex)
+}
+
+// addresses lists all addresses of the wallet
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) addresses() []walletAddress {
+	result := []walletAddress{}
+	for keyIndex, addr := range wallet.Addrs {
+		result = append(result, walletAddress{DefaultAccountName, keyIndex, addr})
+	}
+	for name, account := range wallet.accounts {
+		for keyIndex, addr := range account.addrs {
+			result = append(result, walletAddress{name, keyIndex, addr})
+		}
+	}
+	return result
+}
+
+// lookupAddress finds the wallet address by its string representation
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) lookupAddress(address string) (walletAddress, bool) {
+	for _, owned := range wallet.addresses() {
+		if owned.addr.String() == address {
+			return owned, true
+		}
+	}
+	return walletAddress{}, false
+}
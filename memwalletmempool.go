@@ -0,0 +1,208 @@
+package coinharness
+
+import (
+	"bytes"
+)
+
+// mempoolState tracks unmined transactions relevant to the InMemoryWallet.
+type mempoolState struct {
+	// txs is the set of unmined transactions indexed by hash
+	txs map[Hash]*MessageTx
+
+	// utxos is the set of outputs created by unmined transactions
+	// and paying to the wallet
+	utxos map[OutPoint]*Utxo
+
+	// spent maps wallet outputs spent by unmined transactions
+	// to the spending transaction hash
+	spent map[OutPoint]Hash
+}
+
+func newMempoolState() mempoolState {
+	return mempoolState{
+		txs:   make(map[Hash]*MessageTx),
+		utxos: make(map[OutPoint]*Utxo),
+		spent: make(map[OutPoint]Hash),
+	}
+}
+
+// IngestMempoolTx is a call-back which is to be triggered each time a
+// transaction relevant to the wallet is accepted to the node mempool.
+// The transaction outputs paying to the wallet become unconfirmed Utxos
+// and the wallet outputs it spends are no longer listed as unspent.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) IngestMempoolTx(txBytes []byte) {
+	tx, err := wallet.NewTxFromBytes(txBytes)
+	if err != nil {
+		panic(err)
+	}
+	mtx := tx.MsgTx
+	txHash := mtx.TxHash()
+
+	wallet.Lock()
+	defer wallet.Unlock()
+
+	if _, ok := wallet.mempool.txs[txHash]; ok {
+		return
+	}
+	// The transaction might be already mined
+	for i := range mtx.TxOut {
+		if _, ok := wallet.Utxos[OutPoint{Hash: txHash, Index: uint32(i)}]; ok {
+			return
+		}
+	}
+
+	wallet.mempool.txs[txHash] = mtx
+	for i, output := range mtx.TxOut {
+		for _, owned := range wallet.addresses() {
+			if !bytes.Contains(output.PkScript, owned.addr.ScriptAddress()) {
+				continue
+			}
+			op := OutPoint{Hash: txHash, Index: uint32(i)}
+			wallet.mempool.utxos[op] = &Utxo{
+				value:       output.Value.Copy(),
+				account:     owned.account,
+				keyIndex:    owned.keyIndex,
+				blockHeight: wallet.currentHeight + 1,
+				pkScript:    output.PkScript,
+			}
+		}
+	}
+	for _, txIn := range mtx.TxIn {
+		op := txIn.PreviousOutPoint
+		if _, ok := wallet.lookupUtxo(op); ok {
+			wallet.mempool.spent[op] = txHash
+		}
+	}
+}
+
+// reconcileMempool removes transactions mined by the block from the
+// mempool state, as well as unmined transactions conflicting with them.
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) reconcileMempool(blockTxns []*Tx) {
+	for _, tx := range blockTxns {
+		mtx := tx.MsgTx
+		txHash := mtx.TxHash()
+
+		for _, txIn := range mtx.TxIn {
+			op := txIn.PreviousOutPoint
+			spender, ok := wallet.mempool.spent[op]
+			if !ok {
+				continue
+			}
+			delete(wallet.mempool.spent, op)
+			if spender != txHash {
+				// double spent by the mined transaction
+				wallet.dropMempoolTx(spender)
+			}
+		}
+
+		if _, ok := wallet.mempool.txs[txHash]; !ok {
+			continue
+		}
+		delete(wallet.mempool.txs, txHash)
+		for i := range mtx.TxOut {
+			op := OutPoint{Hash: txHash, Index: uint32(i)}
+			unconfirmed, ok := wallet.mempool.utxos[op]
+			if !ok {
+				continue
+			}
+			delete(wallet.mempool.utxos, op)
+			// Keep the output locked if it was selected to fund
+			// a transaction while unconfirmed
+			if confirmed, ok := wallet.Utxos[op]; ok {
+				confirmed.isLocked = unconfirmed.isLocked
+			}
+		}
+	}
+}
+
+// refreshMempool drops the tracked unmined transactions which are no longer
+// in the node mempool, e.g. expired, evicted, lost on the node restart or left
+// out of the mempool after the block disconnect. The outputs they spend become
+// available to the coin selection again.
+//
+// NOTE: The InMemoryWallet's mutex must NOT be held when this function is
+// called, the node notification handlers are blocked by the mutex while
+// the node is queried.
+func (wallet *InMemoryWallet) refreshMempool() {
+	wallet.RLock()
+	node := wallet.nodeRPC
+	tracked := make([]Hash, 0, len(wallet.mempool.txs))
+	for txHash := range wallet.mempool.txs {
+		tracked = append(tracked, txHash)
+	}
+	wallet.RUnlock()
+	if node == nil || len(tracked) == 0 {
+		return
+	}
+
+	hashes, err := node.GetRawMempool(wallet.MempoolCommand)
+	if err != nil {
+		// The node is not reachable,
+		// the mempool is refreshed on reconnect
+		return
+	}
+	inNodeMempool := make(map[string]bool)
+	for _, txHash := range hashes {
+		inNodeMempool[hashToString(txHash)] = true
+	}
+
+	// The transactions tracked after the query are not checked,
+	// they are already accepted by the node.
+	wallet.Lock()
+	defer wallet.Unlock()
+	for _, txHash := range tracked {
+		if !inNodeMempool[hashToString(txHash)] {
+			wallet.dropMempoolTx(txHash)
+		}
+	}
+}
+
+// dropMempoolTx forgets the unmined transaction and its descendants.
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) dropMempoolTx(txHash Hash) {
+	mtx, ok := wallet.mempool.txs[txHash]
+	if !ok {
+		return
+	}
+	delete(wallet.mempool.txs, txHash)
+
+	for _, txIn := range mtx.TxIn {
+		op := txIn.PreviousOutPoint
+		if wallet.mempool.spent[op] == txHash {
+			delete(wallet.mempool.spent, op)
+		}
+	}
+	for i := range mtx.TxOut {
+		op := OutPoint{Hash: txHash, Index: uint32(i)}
+		delete(wallet.mempool.utxos, op)
+		if spender, ok := wallet.mempool.spent[op]; ok {
+			wallet.dropMempoolTx(spender)
+		}
+	}
+}
+
+// lookupUtxo finds a confirmed or an unconfirmed wallet Utxo. Outpoints
+// with a hash of another type, e.g. StringHash, are matched by the hash string.
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) lookupUtxo(op OutPoint) (*Utxo, bool) {
+	if utxo, ok := wallet.Utxos[op]; ok {
+		return utxo, true
+	}
+	if utxo, ok := wallet.mempool.utxos[op]; ok {
+		return utxo, true
+	}
+	for _, utxos := range []map[OutPoint]*Utxo{wallet.Utxos, wallet.mempool.utxos} {
+		for key, utxo := range utxos {
+			if key.Index == op.Index && hashToString(key.Hash) == hashToString(op.Hash) {
+				return utxo, true
+			}
+		}
+	}
+	return nil, false
+}
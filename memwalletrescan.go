@@ -0,0 +1,164 @@
+package coinharness
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// DefaultAddressGapLimit is the number of consecutive unused addresses
+// the Rescan derives beyond the last used one when the
+// InMemoryWallet.AddressGapLimit is not set
+const DefaultAddressGapLimit = 20
+
+// Rescan walks the node chain from the fromHeight to the toHeight,
+// feeding each block to the wallet in the same way blocks reported by the
+// node are ingested. HD addresses derived from the HdRoot that received
+// coins in the scanned blocks are rediscovered observing the address gap
+// limit.
+//
+// The blocks are queued after already pending chain updates,
+// Rescan returns when they are applied.
+func (wallet *InMemoryWallet) Rescan(fromHeight int64, toHeight int64) error {
+	if fromHeight > toHeight {
+		return fmt.Errorf("invalid rescan range: %v > %v", fromHeight, toHeight)
+	}
+	syncerDone := wallet.syncerDone
+	if syncerDone == nil {
+		return ErrNotRunning
+	}
+
+	updates := make([]*chainUpdate, 0, toHeight-fromHeight+1)
+	for height := fromHeight; height <= toHeight; height++ {
+		blockHash, err := wallet.nodeRPC.GetBlockHash(height)
+		if err != nil {
+			return err
+		}
+		block, err := wallet.nodeRPC.GetBlock(blockHash)
+		if err != nil {
+			return err
+		}
+
+		txns := make([]*Tx, 0, len(block.Transactions))
+		for i, mtx := range block.Transactions {
+			txns = append(txns, &Tx{
+				Hash:  mtx.TxHash(),
+				MsgTx: mtx,
+				Index: i,
+			})
+		}
+		updates = append(updates, &chainUpdate{
+			updateType:   blockConnected,
+			blockHeight:  height,
+			blockHash:    blockHash,
+			filteredTxns: txns,
+		})
+	}
+
+	if err := wallet.discoverAddresses(updates); err != nil {
+		return err
+	}
+
+	for _, update := range updates {
+		wallet.pushChainUpdate(update)
+	}
+	return wallet.waitUpdatesApplied(syncerDone)
+}
+
+// waitUpdatesApplied blocks until the chainSyncer applies
+// the chain updates queued so far
+func (wallet *InMemoryWallet) waitUpdatesApplied(syncerDone chan struct{}) error {
+	done := make(chan struct{})
+	wallet.pushChainUpdate(&chainUpdate{updateType: updatesApplied, done: done})
+	select {
+	case <-done:
+		return nil
+	case <-syncerDone:
+		// The queue is drained when the wallet stops
+		select {
+		case <-done:
+			return nil
+		default:
+			return ErrNotRunning
+		}
+	}
+}
+
+// discoverAddresses derives addresses of each account until AddressGapLimit
+// consecutive addresses have no outputs in the blocks. Discovered addresses
+// are added to the wallet and to the node tx filter.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) discoverAddresses(updates []*chainUpdate) error {
+	gapLimit := wallet.AddressGapLimit
+	if gapLimit == 0 {
+		gapLimit = DefaultAddressGapLimit
+	}
+
+	pkScripts := [][]byte{}
+	for _, update := range updates {
+		for _, tx := range update.filteredTxns {
+			for _, output := range tx.MsgTx.TxOut {
+				pkScripts = append(pkScripts, output.PkScript)
+			}
+		}
+	}
+	isUsed := func(addr Address) bool {
+		pkHash := addr.ScriptAddress()
+		for _, pkScript := range pkScripts {
+			if bytes.Contains(pkScript, pkHash) {
+				return true
+			}
+		}
+		return false
+	}
+
+	wallet.Lock()
+	defer wallet.Unlock()
+
+	discovered := []Address{}
+	for _, accountName := range wallet.accountNames() {
+		hdIndex := &wallet.HdIndex
+		if accountName != DefaultAccountName {
+			hdIndex = &wallet.accounts[accountName].hdIndex
+		}
+
+		// Look ahead for used addresses until the gap limit
+		// is reached after the last used one
+		lastUsed := int64(*hdIndex) - 1
+		for index := *hdIndex; int64(index) <= lastUsed+int64(gapLimit); index++ {
+			childKey, err := wallet.accountKey(accountName, index)
+			if err != nil {
+				return err
+			}
+			privKey, err := childKey.PrivateKey()
+			if err != nil {
+				return err
+			}
+			addr, err := wallet.PrivateKeyKeyToAddr(privKey, wallet.Net)
+			if err != nil {
+				return err
+			}
+			if isUsed(addr) {
+				lastUsed = int64(index)
+			}
+		}
+
+		// Issue all addresses up to the last used one
+		if err := wallet.deriveAddrs(accountName, uint32(lastUsed+1)); err != nil {
+			return err
+		}
+		addrs, err := wallet.accountAddrs(accountName)
+		if err != nil {
+			return err
+		}
+		for index := *hdIndex; int64(index) <= lastUsed; index++ {
+			discovered = append(discovered, addrs[index])
+		}
+		*hdIndex = uint32(lastUsed + 1)
+	}
+
+	if len(discovered) == 0 {
+		return nil
+	}
+	return wallet.nodeRPC.LoadTxFilter(false, discovered)
+}
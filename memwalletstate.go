@@ -0,0 +1,397 @@
+package coinharness
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/jfixby/coin"
+	"github.com/jfixby/pin"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// memWalletStateFileName is the name of the InMemoryWallet state file
+// inside the wallet WorkingDir
+const memWalletStateFileName = "memwallet.json"
+
+// memWalletState is a JSON snapshot of the InMemoryWallet. Addresses are
+// not stored, they are derived again from the HdRoot on load.
+type memWalletState struct {
+	CurrentHeight int64                   `json:"currentHeight"`
+	CurrentHash   string                  `json:"currentHash"`
+	HdIndex       uint32                  `json:"hdIndex"`
+	Accounts      []memWalletAccountState `json:"accounts"`
+	Utxos         []memWalletUtxoState    `json:"utxos"`
+	ReorgJournal  []memWalletUndoState    `json:"reorgJournal"`
+}
+
+type memWalletAccountState struct {
+	Name    string `json:"name"`
+	Number  uint32 `json:"number"`
+	HdIndex uint32 `json:"hdIndex"`
+}
+
+type memWalletOutPointState struct {
+	Hash  string `json:"hash"`
+	Index uint32 `json:"index"`
+	Tree  int8   `json:"tree"`
+}
+
+type memWalletUtxoState struct {
+	OutPoint       memWalletOutPointState `json:"outPoint"`
+	PkScript       string                 `json:"pkScript"`
+	Value          int64                  `json:"value"`
+	BlockHeight    int64                  `json:"blockHeight"`
+	MaturityHeight int64                  `json:"maturityHeight"`
+	Account        string                 `json:"account"`
+	KeyIndex       uint32                 `json:"keyIndex"`
+}
+
+type memWalletUndoState struct {
+	Height         int64                    `json:"height"`
+	BlockHash      string                   `json:"blockHash"`
+	UtxosCreated   []memWalletOutPointState `json:"utxosCreated"`
+	UtxosDestroyed []memWalletUtxoState     `json:"utxosDestroyed"`
+}
+
+// StateFile returns file path of the wallet state snapshot
+// inside the wallet WorkingDir
+func (wallet *InMemoryWallet) StateFile() string {
+	return filepath.Join(wallet.WorkingDir, memWalletStateFileName)
+}
+
+// Save writes the wallet state snapshot to the file. Unmined transactions
+// and locked outputs are not saved. The snapshot is written to a temporary
+// file first, so the file is never left partially written.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) Save(file string) error {
+	data, err := wallet.MarshalState()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// MarshalState returns the wallet state snapshot, unmined transactions
+// and locked outputs are not included. Implements StatefulWallet.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) MarshalState() ([]byte, error) {
+	wallet.RLock()
+	state := &memWalletState{
+		CurrentHeight: wallet.currentHeight,
+		CurrentHash:   hashToString(wallet.currentHash),
+		HdIndex:       wallet.HdIndex,
+	}
+	for name, account := range wallet.accounts {
+		state.Accounts = append(state.Accounts, memWalletAccountState{
+			Name:    name,
+			Number:  account.number,
+			HdIndex: account.hdIndex,
+		})
+	}
+	for op, utxo := range wallet.Utxos {
+		state.Utxos = append(state.Utxos, newUtxoState(op, utxo))
+	}
+	for height, undo := range wallet.ReorgJournal {
+		undoState := memWalletUndoState{
+			Height:    height,
+			BlockHash: hashToString(undo.blockHash),
+		}
+		for _, op := range undo.utxosCreated {
+			undoState.UtxosCreated = append(undoState.UtxosCreated, newOutPointState(op))
+		}
+		for op, utxo := range undo.utxosDestroyed {
+			undoState.UtxosDestroyed = append(undoState.UtxosDestroyed, newUtxoState(op, utxo))
+		}
+		state.ReorgJournal = append(state.ReorgJournal, undoState)
+	}
+	wallet.RUnlock()
+
+	return json.MarshalIndent(state, "", "  ")
+}
+
+// Load replaces the wallet state with the snapshot stored in the file.
+// The wallet must be created with the same HdRoot as the saved one.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) Load(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	if err := wallet.UnmarshalState(data); err != nil {
+		return fmt.Errorf("unable to read wallet state %v: %v", file, err)
+	}
+	return nil
+}
+
+// UnmarshalState replaces the wallet state with the snapshot returned by the
+// MarshalState. Unmined transactions are dropped and all outputs are unlocked.
+// Implements StatefulWallet.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) UnmarshalState(data []byte) error {
+	pin.AssertNotNil("NewHashFromStr", wallet.NewHashFromStr)
+
+	state := &memWalletState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return err
+	}
+
+	// Chain updates queued before the call must not be applied
+	// to the restored state
+	if syncerDone := wallet.syncerDone; syncerDone != nil {
+		if err := wallet.waitUpdatesApplied(syncerDone); err != nil {
+			return err
+		}
+	}
+
+	wallet.Lock()
+	defer wallet.Unlock()
+
+	currentHash, err := wallet.hashFromString(state.CurrentHash)
+	if err != nil {
+		return err
+	}
+	wallet.currentHeight = state.CurrentHeight
+	wallet.currentHash = currentHash
+
+	wallet.accounts = make(map[string]*memWalletAccount)
+	for _, accountState := range state.Accounts {
+		branch, err := wallet.HdRoot.Child(accountBranchOffset + accountState.Number)
+		if err != nil {
+			return err
+		}
+		wallet.accounts[accountState.Name] = &memWalletAccount{
+			number:  accountState.Number,
+			branch:  branch,
+			hdIndex: accountState.HdIndex,
+			addrs:   make(map[uint32]Address),
+		}
+	}
+	wallet.HdIndex = state.HdIndex
+	if wallet.Addrs == nil {
+		wallet.Addrs = make(map[uint32]Address)
+	}
+	if err := wallet.deriveAddrs(DefaultAccountName, wallet.HdIndex); err != nil {
+		return err
+	}
+	for name, account := range wallet.accounts {
+		if err := wallet.deriveAddrs(name, account.hdIndex); err != nil {
+			return err
+		}
+	}
+
+	wallet.Utxos = make(map[OutPoint]*Utxo)
+	for _, utxoState := range state.Utxos {
+		op, utxo, err := wallet.readUtxoState(utxoState)
+		if err != nil {
+			return err
+		}
+		wallet.Utxos[op] = utxo
+	}
+
+	wallet.ReorgJournal = make(map[int64]*UndoEntry)
+	for _, undoState := range state.ReorgJournal {
+		blockHash, err := wallet.hashFromString(undoState.BlockHash)
+		if err != nil {
+			return err
+		}
+		undo := &UndoEntry{
+			blockHash:      blockHash,
+			utxosDestroyed: make(map[OutPoint]*Utxo),
+		}
+		for _, opState := range undoState.UtxosCreated {
+			op, err := wallet.readOutPointState(opState)
+			if err != nil {
+				return err
+			}
+			undo.utxosCreated = append(undo.utxosCreated, op)
+		}
+		for _, utxoState := range undoState.UtxosDestroyed {
+			op, utxo, err := wallet.readUtxoState(utxoState)
+			if err != nil {
+				return err
+			}
+			undo.utxosDestroyed[op] = utxo
+		}
+		wallet.ReorgJournal[undoState.Height] = undo
+	}
+
+	wallet.mempool = newMempoolState()
+	return nil
+}
+
+// unwindStaleBlocks unwinds the loaded wallet state down to the highest block
+// which is still in the node chain, e.g. after the node has switched to
+// another branch or lost blocks while the wallet was stopped.
+//
+// This function is safe for concurrent access.
+func (wallet *InMemoryWallet) unwindStaleBlocks() error {
+	for {
+		wallet.RLock()
+		height := wallet.currentHeight
+		hash := wallet.currentHash
+		_, hasUndo := wallet.ReorgJournal[height]
+		wallet.RUnlock()
+		if height <= 0 {
+			return nil
+		}
+
+		// The node is queried without the lock,
+		// notification handlers are blocked by it
+		nodeHash, err := wallet.nodeRPC.GetBlockHash(height)
+		if err == nil && hash != nil && hashToString(nodeHash) == hashToString(hash) {
+			return nil
+		}
+		if !hasUndo {
+			return fmt.Errorf("saved block %v at height %v is not in the node chain "+
+				"and can not be unwound", hash, height)
+		}
+
+		wallet.Lock()
+		wallet.unwindBlock(&chainUpdate{updateType: blockDisconnected, blockHeight: height})
+		wallet.Unlock()
+	}
+}
+
+// rescanMissedBlocks rescans the node blocks from the fromHeight
+// to the node best block
+func (wallet *InMemoryWallet) rescanMissedBlocks(fromHeight int64) error {
+	_, bestHeight, err := wallet.nodeRPC.GetBestBlock()
+	if err != nil {
+		return err
+	}
+	if fromHeight > bestHeight {
+		return nil
+	}
+	return wallet.Rescan(fromHeight, bestHeight)
+}
+
+// deriveAddrs derives missing account addresses up to the hdIndex
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) deriveAddrs(accountName string, hdIndex uint32) error {
+	addrs, err := wallet.accountAddrs(accountName)
+	if err != nil {
+		return err
+	}
+	for index := uint32(0); index < hdIndex; index++ {
+		if _, ok := addrs[index]; ok {
+			continue
+		}
+		childKey, err := wallet.accountKey(accountName, index)
+		if err != nil {
+			return err
+		}
+		privKey, err := childKey.PrivateKey()
+		if err != nil {
+			return err
+		}
+		addr, err := wallet.PrivateKeyKeyToAddr(privKey, wallet.Net)
+		if err != nil {
+			return err
+		}
+		addrs[index] = addr
+	}
+	return nil
+}
+
+// ParseTxID parses the txID with the wallet NewHashFromStr,
+// the package NewHashFromStr is used when it is not set.
+// Implements TxIDParser.
+func (wallet *InMemoryWallet) ParseTxID(txID string) (Hash, error) {
+	if wallet.NewHashFromStr == nil {
+		return NewHashFromStr(txID)
+	}
+	return wallet.NewHashFromStr(txID)
+}
+
+func (wallet *InMemoryWallet) hashFromString(s string) (Hash, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return wallet.NewHashFromStr(s)
+}
+
+func (wallet *InMemoryWallet) readOutPointState(state memWalletOutPointState) (OutPoint, error) {
+	hash, err := wallet.hashFromString(state.Hash)
+	if err != nil {
+		return OutPoint{}, err
+	}
+	return OutPoint{Hash: hash, Index: state.Index, Tree: state.Tree}, nil
+}
+
+// readUtxoState restores the Utxo, the owning account must be loaded before.
+//
+// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+func (wallet *InMemoryWallet) readUtxoState(state memWalletUtxoState) (OutPoint, *Utxo, error) {
+	op, err := wallet.readOutPointState(state.OutPoint)
+	if err != nil {
+		return OutPoint{}, nil, err
+	}
+	if _, ok := wallet.accounts[state.Account]; !ok && state.Account != DefaultAccountName {
+		return OutPoint{}, nil, fmt.Errorf("output %v:%v belongs to unknown account %q",
+			state.OutPoint.Hash, state.OutPoint.Index, state.Account)
+	}
+	pkScript, err := hex.DecodeString(state.PkScript)
+	if err != nil {
+		return OutPoint{}, nil, err
+	}
+	utxo := &Utxo{
+		pkScript:       pkScript,
+		value:          coin.Amount{AtomsValue: state.Value},
+		blockHeight:    state.BlockHeight,
+		maturityHeight: state.MaturityHeight,
+		account:        state.Account,
+		keyIndex:       state.KeyIndex,
+	}
+	return op, utxo, nil
+}
+
+func newOutPointState(op OutPoint) memWalletOutPointState {
+	return memWalletOutPointState{
+		Hash:  hashToString(op.Hash),
+		Index: op.Index,
+		Tree:  op.Tree,
+	}
+}
+
+func newUtxoState(op OutPoint, utxo *Utxo) memWalletUtxoState {
+	return memWalletUtxoState{
+		OutPoint:       newOutPointState(op),
+		PkScript:       hex.EncodeToString(utxo.pkScript),
+		Value:          utxo.value.AtomsValue,
+		BlockHeight:    utxo.blockHeight,
+		MaturityHeight: utxo.maturityHeight,
+		Account:        utxo.account,
+		KeyIndex:       utxo.keyIndex,
+	}
+}
+
+func hashToString(hash Hash) string {
+	if hash == nil {
+		return ""
+	}
+	return hash.String()
+}
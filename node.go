@@ -1,9 +1,44 @@
 package coinharness
 
+import (
+	"fmt"
+	"time"
+)
+
+// ErrAlreadyRunning is returned when starting a process which is
+// already running
+var ErrAlreadyRunning = fmt.Errorf("process is already running")
+
+// ErrNotRunning is returned when stopping a process which is not running
+var ErrNotRunning = fmt.Errorf("process is not running")
+
+// CertFileTimeoutError is returned when a launched process did not produce
+// its RPC certificate file in time
+type CertFileTimeoutError struct {
+	CertFile string
+	Timeout  time.Duration
+}
+
+func (e *CertFileTimeoutError) Error() string {
+	return fmt.Sprintf("cert file %v did not appear in %v", e.CertFile, e.Timeout)
+}
+
+// RPCConnectError is returned when RPC client failed to connect
+// to a launched process
+type RPCConnectError struct {
+	Host string
+	Err  error
+}
+
+func (e *RPCConnectError) Error() string {
+	return fmt.Sprintf("unable to connect RPC client to %v: %v", e.Host, e.Err)
+}
+
 type StartNodeArgs struct {
-	DebugOutput    bool
-	MiningAddress  Address
-	ExtraArguments map[string]interface{}
+	DebugOutput              bool
+	MiningAddress            Address
+	ExtraArguments           map[string]interface{}
+	MaxSecondsToWaitOnLaunch int
 }
 
 // Node wraps optional test node implementations for different test setups
@@ -12,10 +47,10 @@ type Node interface {
 	Network() Network
 
 	// Start node process
-	Start(args *StartNodeArgs)
+	Start(args *StartNodeArgs) error
 
 	// Stop node process
-	Stop()
+	Stop() error
 
 	// Dispose releases all resources allocated by the node
 	// This action is final (irreversible)
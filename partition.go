@@ -0,0 +1,66 @@
+package coinharness
+
+import (
+	"fmt"
+)
+
+// NetworkPartition records connections dropped by the Partition,
+// so they can be restored by the Heal
+type NetworkPartition struct {
+	// dropped connections, the first harness of each pair
+	// has connected to the second one
+	dropped [][2]*Harness
+}
+
+// Partition splits harnesses into isolated groups by disconnecting each
+// connected pair of harnesses from different groups. Connections inside
+// the groups are kept.
+func Partition(groups ...[]*Harness) (*NetworkPartition, error) {
+	partition := &NetworkPartition{}
+	for i, group := range groups {
+		for _, other := range groups[i+1:] {
+			for _, a := range group {
+				for _, b := range other {
+					if err := partition.split(a, b); err != nil {
+						return partition, err
+					}
+				}
+			}
+		}
+	}
+	return partition, nil
+}
+
+// split disconnects the harnesses and records the dropped connection
+func (partition *NetworkPartition) split(a *Harness, b *Harness) error {
+	conn, err := connectionBetween(a, b)
+	if err != nil {
+		return err
+	}
+	if !conn.connected() {
+		return nil
+	}
+	if err := DisconnectNode(a, b); err != nil {
+		return err
+	}
+	if conn.outbound {
+		partition.dropped = append(partition.dropped, [2]*Harness{a, b})
+	} else {
+		partition.dropped = append(partition.dropped, [2]*Harness{b, a})
+	}
+	return nil
+}
+
+// Heal restores connections dropped by the Partition.
+// Use JoinNodes to wait until the nodes converge.
+func (partition *NetworkPartition) Heal() error {
+	for len(partition.dropped) > 0 {
+		pair := partition.dropped[0]
+		if err := ConnectNode(pair[0], pair[1], AddNodeAdd); err != nil {
+			return fmt.Errorf("unable to reconnect %v to %v: %v",
+				pair[0].Name, pair[1].Name, err)
+		}
+		partition.dropped = partition.dropped[1:]
+	}
+	return nil
+}
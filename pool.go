@@ -0,0 +1,256 @@
+package coinharness
+
+import (
+	"context"
+	"fmt"
+	"github.com/jfixby/pin"
+	"sync"
+	"time"
+)
+
+// PooledSpawner keeps warm harnesses deployed by the Spawner. A disposed
+// harness is reset to the chain and the wallet state it had right after
+// deployment and handed out again on the next NewInstance call with the same
+// name, instead of launching processes and generating a new chain. The harness
+// is restarted when the reset leaves transactions in the node mempool.
+// A harness which can not be reset to a clean state is disposed, the next
+// NewInstance call with the same name deploys a new one.
+type PooledSpawner struct {
+	Spawner *ChainWithMatureOutputsSpawner
+
+	// MempoolCommand is the chain-specific command passed
+	// to the GetRawMempool to check the reset harness mempool is empty
+	MempoolCommand interface{}
+
+	// harnesses maps harness names to deployed harnesses
+	harnesses map[string]*pooledHarness
+	mtx       sync.Mutex
+}
+
+// pooledHarness is a harness kept by the PooledSpawner
+type pooledHarness struct {
+	harness *Harness
+
+	// checkpoint is the chain tip right after the deployment
+	checkpoint *Checkpoint
+
+	inUse bool
+}
+
+// NewInstance returns the warm harness for the name
+// or deploys a new one using the Spawner
+func (pool *PooledSpawner) NewInstance(harnessName string) pin.Spawnable {
+	pool.mtx.Lock()
+	if pool.harnesses == nil {
+		pool.harnesses = make(map[string]*pooledHarness)
+	}
+	pooled, ok := pool.harnesses[harnessName]
+	if ok {
+		if pooled.inUse {
+			pool.mtx.Unlock()
+			pin.ReportTestSetupMalfunction(
+				fmt.Errorf("harness %v is already in use", harnessName))
+		}
+		pooled.inUse = true
+		pool.mtx.Unlock()
+		return pooled.harness
+	}
+	pool.mtx.Unlock()
+
+	harness := pool.Spawner.NewInstance(harnessName).(*Harness)
+	checkpoint, err := harness.Checkpoint()
+	pin.CheckTestSetupMalfunction(err)
+
+	pool.mtx.Lock()
+	pool.harnesses[harnessName] = &pooledHarness{
+		harness:    harness,
+		checkpoint: checkpoint,
+		inUse:      true,
+	}
+	pool.mtx.Unlock()
+	return harness
+}
+
+// Dispose resets the harness to the checkpoint
+// and keeps it for the next NewInstance call
+func (pool *PooledSpawner) Dispose(s pin.Spawnable) error {
+	h := s.(*Harness)
+	if h == nil {
+		return nil
+	}
+	pool.mtx.Lock()
+	pooled, ok := pool.harnesses[h.Name]
+	pool.mtx.Unlock()
+	if !ok || pooled.harness != h {
+		return pool.Spawner.Dispose(h)
+	}
+
+	// A failed harness is disposed keeping its logs,
+	// a new one is deployed on the next NewInstance call
+	if h.Failed() {
+		pool.mtx.Lock()
+		delete(pool.harnesses, h.Name)
+		pool.mtx.Unlock()
+		return pool.Spawner.Dispose(h)
+	}
+
+	if err := pool.reset(h, pooled.checkpoint); err != nil {
+		// A harness in unknown state is not reused,
+		// a new one is deployed on the next NewInstance call
+		pool.mtx.Lock()
+		delete(pool.harnesses, h.Name)
+		pool.mtx.Unlock()
+		return pool.Spawner.Dispose(h)
+	}
+
+	pool.mtx.Lock()
+	pooled.inUse = false
+	pool.mtx.Unlock()
+	return nil
+}
+
+// reset resets the harness to the checkpoint. Transactions of the invalidated
+// blocks return to the node mempool, the node drops them on restart.
+func (pool *PooledSpawner) reset(h *Harness, checkpoint *Checkpoint) error {
+	ctx, cancel := context.WithTimeout(context.Background(), WalletSyncTimeout)
+	defer cancel()
+	err := h.Reset(ctx, checkpoint, pool.MempoolCommand)
+	if err != ErrMempoolNotEmpty {
+		return err
+	}
+	if err := restartHarness(h, relaunchArguments(pool.Spawner)); err != nil {
+		return err
+	}
+	return h.Reset(ctx, checkpoint, pool.MempoolCommand)
+}
+
+// NameForTag defines policy for mapping input tags to harness names
+func (pool *PooledSpawner) NameForTag(tag string) string {
+	return pool.Spawner.NameForTag(tag)
+}
+
+// DisposeAll disposes all harnesses kept by the pool
+func (pool *PooledSpawner) DisposeAll() error {
+	pool.mtx.Lock()
+	harnesses := pool.harnesses
+	pool.harnesses = nil
+	pool.mtx.Unlock()
+
+	var lastErr error
+	for _, pooled := range harnesses {
+		if err := pool.Spawner.Dispose(pooled.harness); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Checkpoint is the node chain tip and the wallet state
+// a harness can be reset to
+type Checkpoint struct {
+	Height int64
+	Hash   Hash
+
+	// WalletState is the snapshot of the StatefulWallet,
+	// nil for other wallets
+	WalletState []byte
+}
+
+// StatefulWallet is implemented by wallets which state can be captured
+// at the Checkpoint and restored on the harness Reset
+type StatefulWallet interface {
+	// MarshalState returns the wallet state snapshot
+	MarshalState() ([]byte, error)
+
+	// UnmarshalState replaces the wallet state with the snapshot
+	UnmarshalState(data []byte) error
+}
+
+// ErrMempoolNotEmpty is returned by the Reset when the node mempool
+// has transactions after the reset
+var ErrMempoolNotEmpty = fmt.Errorf("node mempool is not empty after reset")
+
+// Checkpoint returns the current chain tip of the harness node
+// and the wallet state synced to it
+func (harness *Harness) Checkpoint() (*Checkpoint, error) {
+	hash, height, err := harness.NodeRPCClient().GetBestBlock()
+	if err != nil {
+		return nil, err
+	}
+	checkpoint := &Checkpoint{Height: height, Hash: hash}
+	if wallet, ok := harness.Wallet.(StatefulWallet); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), WalletSyncTimeout)
+		defer cancel()
+		if _, err := harness.Wallet.Sync(ctx, height, nil); err != nil {
+			return nil, err
+		}
+		checkpoint.WalletState, err = wallet.MarshalState()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return checkpoint, nil
+}
+
+// Reset invalidates node blocks above the checkpoint, waits until the wallet
+// follows the node back to the checkpoint height and restores the wallet
+// state, e.g. accounts, addresses and unlocked outputs, of the checkpoint.
+//
+// Transactions of the invalidated blocks return to the node mempool,
+// so Reset fails with the ErrMempoolNotEmpty when the mempool is not empty
+// afterwards. Reset also fails when the node tip is not the checkpoint block
+// after the rewind, e.g. when the node has switched to a side chain.
+func (harness *Harness) Reset(ctx context.Context, checkpoint *Checkpoint, mempoolCommand interface{}) error {
+	node := harness.NodeRPCClient()
+	_, bestHeight, err := node.GetBestBlock()
+	if err != nil {
+		return err
+	}
+	if bestHeight > checkpoint.Height {
+		hash, err := node.GetBlockHash(checkpoint.Height + 1)
+		if err != nil {
+			return err
+		}
+		if err := node.InvalidateBlock(hash); err != nil {
+			return err
+		}
+	}
+
+	tipHash, tipHeight, err := node.GetBestBlock()
+	if err != nil {
+		return err
+	}
+	if tipHeight != checkpoint.Height || hashToString(tipHash) != hashToString(checkpoint.Hash) {
+		return fmt.Errorf("node tip is %v at %v after reset, expected checkpoint %v at %v",
+			tipHash, tipHeight, checkpoint.Hash, checkpoint.Height)
+	}
+
+	mempool, err := node.GetRawMempool(mempoolCommand)
+	if err != nil {
+		return err
+	}
+	if len(mempool) > 0 {
+		return ErrMempoolNotEmpty
+	}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		walletHeight := harness.Wallet.SyncedHeight()
+		if walletHeight == checkpoint.Height {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("wallet is at height %v, reset height %v is not reached: %v",
+				walletHeight, checkpoint.Height, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+
+	wallet, ok := harness.Wallet.(StatefulWallet)
+	if !ok || checkpoint.WalletState == nil {
+		return nil
+	}
+	return wallet.UnmarshalState(checkpoint.WalletState)
+}
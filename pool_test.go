@@ -0,0 +1,120 @@
+package coinharness
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// resettableRPCClient invalidates blocks of the chain
+// and reports the disconnected blocks
+type resettableRPCClient struct {
+	fakeChainRPCClient
+	mempool      []Hash
+	onDisconnect func(height int64)
+}
+
+func (c *resettableRPCClient) InvalidateBlock(hash Hash) error {
+	for height := int64(len(c.blocks) - 1); height > 0; height-- {
+		c.blocks = c.blocks[:height]
+		c.onDisconnect(height)
+		if blockHashAt(height) == hash {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (c *resettableRPCClient) GetRawMempool(command interface{}) ([]Hash, error) {
+	return c.mempool, nil
+}
+
+// rpcNode is connected to the node RPC client
+type rpcNode struct {
+	disposableNode
+	client RPCClient
+}
+
+func (node *rpcNode) RPCClient() *RPCConnection {
+	return &RPCConnection{rpcClient: node.client}
+}
+
+func TestHarnessResetRestoresWalletState(t *testing.T) {
+	wallet := newTestStateWallet("")
+	wallet.Addrs[0] = testAddress("root/0")
+	wallet.HdIndex = 1
+	wallet.syncerDone = make(chan struct{})
+	go wallet.chainSyncer(wallet.syncerDone)
+	t.Cleanup(func() { wallet.ChainUpdateSignal <- stopSignal })
+
+	node := &resettableRPCClient{
+		fakeChainRPCClient: fakeChainRPCClient{
+			blocks: newTestChain(10, map[int64]string{5: "root/0"}),
+		},
+		onDisconnect: func(height int64) {
+			wallet.pushChainUpdate(&chainUpdate{
+				updateType:  blockDisconnected,
+				blockHeight: height,
+				blockHash:   blockHashAt(height),
+			})
+		},
+	}
+	wallet.nodeRPC = node
+	for height := int64(1); height <= 10; height++ {
+		wallet.pushChainUpdate(newTestChainUpdate(node.blocks, height))
+	}
+	syncTestWallet(t, wallet, 10)
+
+	harness := &Harness{Node: &rpcNode{client: node}, Wallet: wallet}
+	checkpoint, err := harness.Checkpoint()
+	if err != nil {
+		t.Fatalf("unable to create checkpoint: %v", err)
+	}
+
+	// The test creates an account and an address, locks the output
+	// by an unbroadcast transaction and mines two blocks
+	if err := wallet.CreateNewAccount("extra"); err != nil {
+		t.Fatalf("unable to create account: %v", err)
+	}
+	if _, err := wallet.NewAddress(DefaultAccountName); err != nil {
+		t.Fatalf("unable to create address: %v", err)
+	}
+	funding := OutPoint{Hash: testHash("pay-5")}
+	if err := wallet.LockOutputs([]TxIn{{PreviousOutPoint: funding}}); err != nil {
+		t.Fatalf("unable to lock output: %v", err)
+	}
+	node.blocks = newTestChain(12, nil)
+	for height := int64(11); height <= 12; height++ {
+		wallet.pushChainUpdate(newTestChainUpdate(node.blocks, height))
+	}
+	syncTestWallet(t, wallet, 12)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Transactions of the invalidated blocks are back in the node mempool
+	node.mempool = []Hash{testHash("mined-at-11")}
+	if err := harness.Reset(ctx, checkpoint, nil); err != ErrMempoolNotEmpty {
+		t.Fatalf("reset error %v, expected %v", err, ErrMempoolNotEmpty)
+	}
+
+	node.mempool = nil
+	if err := harness.Reset(ctx, checkpoint, nil); err != nil {
+		t.Fatalf("unable to reset harness: %v", err)
+	}
+	if height := wallet.SyncedHeight(); height != 10 {
+		t.Fatalf("wallet is at height %v after reset, expected 10", height)
+	}
+	if err := wallet.CreateNewAccount("extra"); err != nil {
+		t.Fatalf("account of the previous test is left: %v", err)
+	}
+	wallet.RLock()
+	defer wallet.RUnlock()
+	if wallet.HdIndex != 1 {
+		t.Fatalf("HdIndex is %v after reset, expected 1", wallet.HdIndex)
+	}
+	utxo, ok := wallet.Utxos[funding]
+	if !ok || utxo.isLocked {
+		t.Fatal("output of the checkpoint is missing or locked after reset")
+	}
+}
@@ -5,4 +5,8 @@ package coinharness
 type NetPortManager interface {
 	// ObtainPort provides a new network port number upon request.
 	ObtainPort() int
+
+	// ReleasePort returns the port obtained by the ObtainPort,
+	// so it can be issued again.
+	ReleasePort(port int)
 }
@@ -0,0 +1,212 @@
+package coinharness
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// processExitLogLines is the number of log lines
+// reported by the ProcessExitError
+const processExitLogLines = 20
+
+// ProcessExitError describes an external process exited
+// without being stopped
+type ProcessExitError struct {
+	Command  string
+	ExitCode int
+	LogFile  string
+	LogTail  []string
+}
+
+func (e *ProcessExitError) Error() string {
+	return fmt.Sprintf("%v exited unexpectedly with code %v, last lines of %v:\n%v",
+		e.Command, e.ExitCode, e.LogFile, strings.Join(e.LogTail, "\n"))
+}
+
+// processStopTimeout is the time given to an interrupted process
+// to exit gracefully before it is killed
+const processStopTimeout = 30 * time.Second
+
+// ConsoleProcess runs an external executable writing its stdout and stderr
+// to the LogFile. Unlike the commandline.ExternalProcess it keeps the output
+// of each process separately, so concurrent harnesses do not mix their logs.
+type ConsoleProcess struct {
+	CommandName string
+	Arguments   []string
+
+	// LogFile receives stdout and stderr of the process
+	LogFile string
+
+	cmd      *exec.Cmd
+	logFile  *os.File
+	done     chan struct{}
+	stopping bool
+	exit     *ProcessExitError
+	onExit   func(exit *ProcessExitError)
+	mtx      sync.Mutex
+}
+
+// SetOnExit registers the callback invoked when the process
+// exits without being stopped
+func (process *ConsoleProcess) SetOnExit(onExit func(exit *ProcessExitError)) {
+	process.mtx.Lock()
+	defer process.mtx.Unlock()
+	process.onExit = onExit
+}
+
+// UnexpectedExit returns the ProcessExitError when the last launched
+// process exited without being stopped, nil otherwise
+func (process *ConsoleProcess) UnexpectedExit() error {
+	process.mtx.Lock()
+	defer process.mtx.Unlock()
+	if process.exit == nil {
+		return nil
+	}
+	return process.exit
+}
+
+// FullConsoleCommand returns the full console command used to
+// launch the process
+func (process *ConsoleProcess) FullConsoleCommand() string {
+	return strings.Join(append([]string{process.CommandName}, process.Arguments...), " ")
+}
+
+// IsRunning returns true if the process is launched and has not exited yet
+func (process *ConsoleProcess) IsRunning() bool {
+	process.mtx.Lock()
+	defer process.mtx.Unlock()
+	if process.cmd == nil {
+		return false
+	}
+	select {
+	case <-process.done:
+		return false
+	default:
+		return true
+	}
+}
+
+// Launch starts the process. The output is appended to the LogFile
+// and duplicated to the console when debugOutput is set.
+func (process *ConsoleProcess) Launch(debugOutput bool) error {
+	if process.IsRunning() {
+		return ErrAlreadyRunning
+	}
+
+	if err := os.MkdirAll(filepath.Dir(process.LogFile), 0700); err != nil {
+		return err
+	}
+	logFile, err := os.OpenFile(process.LogFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+
+	var output io.Writer = logFile
+	if debugOutput {
+		output = io.MultiWriter(logFile, os.Stdout)
+	}
+
+	cmd := exec.Command(process.CommandName, process.Arguments...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	if err := cmd.Start(); err != nil {
+		logFile.Close()
+		return err
+	}
+
+	done := make(chan struct{})
+	process.mtx.Lock()
+	process.cmd = cmd
+	process.logFile = logFile
+	process.done = done
+	process.stopping = false
+	process.exit = nil
+	process.mtx.Unlock()
+
+	go process.watch(cmd, logFile, done)
+	return nil
+}
+
+// watch waits for the process to exit and records
+// the exit when it was not requested by the Stop
+func (process *ConsoleProcess) watch(cmd *exec.Cmd, logFile *os.File, done chan struct{}) {
+	cmd.Wait()
+	logFile.Close()
+
+	process.mtx.Lock()
+	var onExit func(exit *ProcessExitError)
+	if !process.stopping {
+		logTail, _ := tailFile(process.LogFile, processExitLogLines)
+		process.exit = &ProcessExitError{
+			Command:  process.CommandName,
+			ExitCode: cmd.ProcessState.ExitCode(),
+			LogFile:  process.LogFile,
+			LogTail:  logTail,
+		}
+		onExit = process.onExit
+	}
+	exit := process.exit
+	close(done)
+	process.mtx.Unlock()
+
+	if onExit != nil {
+		onExit(exit)
+	}
+}
+
+// Stop interrupts the process and waits for it to exit,
+// the process is killed if it does not exit in time.
+func (process *ConsoleProcess) Stop() error {
+	if !process.IsRunning() {
+		return ErrNotRunning
+	}
+	process.mtx.Lock()
+	cmd := process.cmd
+	done := process.done
+	process.stopping = true
+	process.mtx.Unlock()
+
+	// Interrupt is not supported on Windows
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		if err := cmd.Process.Kill(); err != nil {
+			return err
+		}
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(processStopTimeout):
+		if err := cmd.Process.Kill(); err != nil {
+			return err
+		}
+		<-done
+		return fmt.Errorf("process %v was killed after %v timeout",
+			process.CommandName, processStopTimeout)
+	}
+}
+
+// TailLog returns the last n lines of the LogFile
+func (process *ConsoleProcess) TailLog(n int) ([]string, error) {
+	return tailFile(process.LogFile, n)
+}
+
+// tailFile returns the last n lines of the file
+func tailFile(file string, n int) ([]string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	lines := strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines, nil
+}
@@ -0,0 +1,180 @@
+package coinharness
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"time"
+)
+
+// DefaultMaxSecondsToWaitOnLaunch is used when start arguments
+// do not set MaxSecondsToWaitOnLaunch
+const DefaultMaxSecondsToWaitOnLaunch = 90
+
+// ReadinessProbe decides when a launched node or wallet process
+// is ready for incoming RPC calls
+type ReadinessProbe interface {
+	// WaitReady blocks until the process is ready,
+	// returns an error when the ctx is done first
+	WaitReady(ctx context.Context, target *ProbeTarget) error
+}
+
+// ProbeTarget describes the launched process for the ReadinessProbe
+type ProbeTarget struct {
+	CertFile      string
+	LogFile       string
+	RPCConfig     RPCConnectionConfig
+	ClientFactory RPCClientFactory
+
+	// Process is checked to stop waiting once it exits
+	Process *ConsoleProcess
+}
+
+// ReadinessProbes waits for each of the probes in order
+type ReadinessProbes []ReadinessProbe
+
+// WaitReady implements ReadinessProbe
+func (probes ReadinessProbes) WaitReady(ctx context.Context, target *ProbeTarget) error {
+	for _, probe := range probes {
+		if err := probe.WaitReady(ctx, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WaitForFileProbe waits for the File to appear,
+// the RPC cert file of the process when the File is empty.
+// This is the default ReadinessProbe, RPC server creates the cert file
+// when it is ready for incoming calls.
+type WaitForFileProbe struct {
+	File string
+}
+
+// WaitReady implements ReadinessProbe
+func (probe *WaitForFileProbe) WaitReady(ctx context.Context, target *ProbeTarget) error {
+	file := probe.File
+	if file == "" {
+		file = target.CertFile
+	}
+	start := time.Now()
+	err := pollUntilReady(ctx, target, func() bool {
+		_, err := os.Stat(file)
+		return err == nil
+	})
+	if err == ctx.Err() && err != nil {
+		return &CertFileTimeoutError{CertFile: file, Timeout: time.Since(start)}
+	}
+	return err
+}
+
+// TCPPortProbe waits until the Address accepts TCP connections,
+// the RPC listen address of the process when the Address is empty
+type TCPPortProbe struct {
+	Address string
+}
+
+// WaitReady implements ReadinessProbe
+func (probe *TCPPortProbe) WaitReady(ctx context.Context, target *ProbeTarget) error {
+	address := probe.Address
+	if address == "" {
+		address = target.RPCConfig.Host
+	}
+	err := pollUntilReady(ctx, target, func() bool {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	})
+	if err == ctx.Err() && err != nil {
+		return fmt.Errorf("port %v is not open: %v", address, err)
+	}
+	return err
+}
+
+// RPCPingProbe waits until the process answers the GetBestBlock RPC call
+type RPCPingProbe struct {
+}
+
+// WaitReady implements ReadinessProbe
+func (probe *RPCPingProbe) WaitReady(ctx context.Context, target *ProbeTarget) error {
+	var lastErr error
+	err := pollUntilReady(ctx, target, func() bool {
+		client, err := target.ClientFactory.NewRPCConnection(target.RPCConfig, nil)
+		if err != nil {
+			lastErr = err
+			return false
+		}
+		defer client.Shutdown()
+		_, _, lastErr = client.GetBestBlock()
+		return lastErr == nil
+	})
+	if err == ctx.Err() && err != nil {
+		return &RPCConnectError{Host: target.RPCConfig.Host, Err: lastErr}
+	}
+	return err
+}
+
+// LogLineProbe waits until the process log has a line
+// matching the Pattern
+type LogLineProbe struct {
+	Pattern *regexp.Regexp
+}
+
+// WaitReady implements ReadinessProbe
+func (probe *LogLineProbe) WaitReady(ctx context.Context, target *ProbeTarget) error {
+	err := pollUntilReady(ctx, target, func() bool {
+		data, err := ioutil.ReadFile(target.LogFile)
+		if err != nil {
+			return false
+		}
+		return probe.Pattern.Match(data)
+	})
+	if err == ctx.Err() && err != nil {
+		return fmt.Errorf("%v has no line matching %v: %v",
+			target.LogFile, probe.Pattern, err)
+	}
+	return err
+}
+
+// pollUntilReady calls ready until it returns true. Returns the ctx error
+// when the ctx is done first, or the ProcessExitError when the process exits.
+func pollUntilReady(ctx context.Context, target *ProbeTarget, ready func() bool) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if ready() {
+			return nil
+		}
+		if target.Process != nil {
+			if exit := target.Process.UnexpectedExit(); exit != nil {
+				return exit
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitReady waits for the probe within maxSecondsToWait,
+// DefaultMaxSecondsToWaitOnLaunch when not set
+func waitReady(probe ReadinessProbe, target *ProbeTarget, maxSecondsToWait int) error {
+	if probe == nil {
+		probe = &WaitForFileProbe{}
+	}
+	if maxSecondsToWait <= 0 {
+		maxSecondsToWait = DefaultMaxSecondsToWaitOnLaunch
+	}
+	timeout := time.Duration(maxSecondsToWait) * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return probe.WaitReady(ctx, target)
+}
@@ -21,6 +21,7 @@ type RPCClient interface {
 	GetBlockCount() (int64, error)
 	GetRawMempool(command interface{}) ([]Hash, error)
 	AddNode(arguments *AddNodeArguments) error
+	DisconnectNode(targetAddr string) error
 	Internal() interface{}
 	Generate(blocks uint32) ([]Hash, error)
 	SendRawTransaction(tx *MessageTx, b bool) (Hash, error)
@@ -36,9 +37,12 @@ type RPCClient interface {
 	WalletLock() error
 	WalletInfo() (*WalletInfoResult, error)
 	GetBlock(hash Hash) (*MsgBlock, error)
+	GetBlockHash(blockHeight int64) (Hash, error)
+	InvalidateBlock(hash Hash) error
 	SubmitBlock(block Block) error
 	LoadTxFilter(b bool, addresses []Address) error
 	ListAccounts() (map[string]coin.Amount, error)
+	SendFrom(account string, address Address, amount coin.Amount) (Hash, error)
 }
 
 // Unspent models a successful response from the listunspent request.
@@ -56,7 +60,9 @@ type Unspent struct {
 	Spendable     bool
 }
 
+// MsgBlock is a chain-agnostic block
 type MsgBlock struct {
+	Header       BlockHeader
 	Transactions []*MessageTx
 }
 
@@ -65,6 +71,9 @@ type Block interface {
 
 type PeerInfo struct {
 	Addr string
+	// AddrLocal is the local address of the connection,
+	// the address the remote node sees for an inbound peer
+	AddrLocal string
 }
 
 type BuildVersion interface {
@@ -81,6 +90,15 @@ type RPCConnection struct {
 
 // NewRPCConnection produces new instance of the RPCConnection
 func NewRPCConnection(fact RPCClientFactory, config RPCConnectionConfig, maxConnRetries int, ntfnHandlers *NotificationHandlers) RPCClient {
+	client, err := dialRPCClient(fact, config, maxConnRetries, ntfnHandlers)
+	if err != nil {
+		pin.ReportTestSetupMalfunction(err)
+	}
+	return client
+}
+
+// dialRPCClient connects a new RPC client retrying up to maxConnRetries times
+func dialRPCClient(fact RPCClientFactory, config RPCConnectionConfig, maxConnRetries int, ntfnHandlers *NotificationHandlers) (RPCClient, error) {
 	var client RPCClient
 	var err error
 
@@ -94,21 +112,30 @@ func NewRPCConnection(fact RPCClientFactory, config RPCConnectionConfig, maxConn
 		break
 	}
 	if client == nil {
-		pin.ReportTestSetupMalfunction(fmt.Errorf("client connection timedout"))
+		if err == nil {
+			err = fmt.Errorf("client connection timedout")
+		}
+		return nil, &RPCConnectError{Host: config.Host, Err: err}
 	}
-	return client
+	return client, nil
 }
 
 // Connect switches RPCConnection into connected state establishing RPCConnection to the rpcConf target
-func (client *RPCConnection) Connect(rpcConf RPCConnectionConfig, ntfnHandlers *NotificationHandlers) {
+func (client *RPCConnection) Connect(rpcConf RPCConnectionConfig, ntfnHandlers *NotificationHandlers) error {
 	if client.isConnected {
-		pin.ReportTestSetupMalfunction(fmt.Errorf("%v is already connected", client.rpcClient))
+		return fmt.Errorf("%v is already connected", client.rpcClient)
+	}
+	rpcClient, err := dialRPCClient(client.RPCClientFactory, rpcConf, client.MaxConnRetries, ntfnHandlers)
+	if err != nil {
+		return err
+	}
+	if err := rpcClient.NotifyBlocks(); err != nil {
+		rpcClient.Shutdown()
+		return &RPCConnectError{Host: rpcConf.Host, Err: err}
 	}
-	client.isConnected = true
-	rpcClient := NewRPCConnection(client.RPCClientFactory, rpcConf, client.MaxConnRetries, ntfnHandlers)
-	err := rpcClient.NotifyBlocks()
-	pin.CheckTestSetupMalfunction(err)
 	client.rpcClient = rpcClient
+	client.isConnected = true
+	return nil
 }
 
 // Disconnect switches RPCConnection into offline state
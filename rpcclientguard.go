@@ -0,0 +1,220 @@
+package coinharness
+
+import (
+	"github.com/jfixby/coin"
+)
+
+// processAwareRPCClient wraps RPCClient of an external process.
+// Once the process exits unexpectedly, calls fail with the
+// ProcessExitError instead of a connection error.
+type processAwareRPCClient struct {
+	RPCClient
+	process *ConsoleProcess
+}
+
+func newProcessAwareRPCClient(client RPCClient, process *ConsoleProcess) RPCClient {
+	return &processAwareRPCClient{RPCClient: client, process: process}
+}
+
+// explain replaces the call error with the process exit error
+// when the process is gone
+func (c *processAwareRPCClient) explain(err error) error {
+	if err == nil {
+		return nil
+	}
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return err
+}
+
+func (c *processAwareRPCClient) NotifyBlocks() error {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return c.explain(c.RPCClient.NotifyBlocks())
+}
+
+func (c *processAwareRPCClient) GetPeerInfo() ([]PeerInfo, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.GetPeerInfo()
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) GetBlockCount() (int64, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return 0, exit
+	}
+	r, err := c.RPCClient.GetBlockCount()
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) GetRawMempool(command interface{}) ([]Hash, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.GetRawMempool(command)
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) AddNode(arguments *AddNodeArguments) error {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return c.explain(c.RPCClient.AddNode(arguments))
+}
+
+func (c *processAwareRPCClient) DisconnectNode(targetAddr string) error {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return c.explain(c.RPCClient.DisconnectNode(targetAddr))
+}
+
+func (c *processAwareRPCClient) Generate(blocks uint32) ([]Hash, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.Generate(blocks)
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) SendRawTransaction(tx *MessageTx, b bool) (Hash, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.SendRawTransaction(tx, b)
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) GetNewAddress(accountName string) (Address, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.GetNewAddress(accountName)
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) GetBuildVersion() (BuildVersion, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.GetBuildVersion()
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) GetBestBlock() (Hash, int64, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, 0, exit
+	}
+	r0, r1, err := c.RPCClient.GetBestBlock()
+	return r0, r1, c.explain(err)
+}
+
+func (c *processAwareRPCClient) ValidateAddress(address Address) (*ValidateAddressResult, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.ValidateAddress(address)
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) CreateNewAccount(accountName string) error {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return c.explain(c.RPCClient.CreateNewAccount(accountName))
+}
+
+func (c *processAwareRPCClient) GetBalance() (*GetBalanceResult, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.GetBalance()
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) ListUnspent() ([]*Unspent, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.ListUnspent()
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) WalletUnlock(walletPassphrase string, timeout int64) error {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return c.explain(c.RPCClient.WalletUnlock(walletPassphrase, timeout))
+}
+
+func (c *processAwareRPCClient) WalletLock() error {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return c.explain(c.RPCClient.WalletLock())
+}
+
+func (c *processAwareRPCClient) WalletInfo() (*WalletInfoResult, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.WalletInfo()
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) GetBlock(hash Hash) (*MsgBlock, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.GetBlock(hash)
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) GetBlockHash(blockHeight int64) (Hash, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.GetBlockHash(blockHeight)
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) InvalidateBlock(hash Hash) error {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return c.explain(c.RPCClient.InvalidateBlock(hash))
+}
+
+func (c *processAwareRPCClient) SubmitBlock(block Block) error {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return c.explain(c.RPCClient.SubmitBlock(block))
+}
+
+func (c *processAwareRPCClient) LoadTxFilter(b bool, addresses []Address) error {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return exit
+	}
+	return c.explain(c.RPCClient.LoadTxFilter(b, addresses))
+}
+
+func (c *processAwareRPCClient) ListAccounts() (map[string]coin.Amount, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.ListAccounts()
+	return r, c.explain(err)
+}
+
+func (c *processAwareRPCClient) SendFrom(account string, address Address, amount coin.Amount) (Hash, error) {
+	if exit := c.process.UnexpectedExit(); exit != nil {
+		return nil, exit
+	}
+	r, err := c.RPCClient.SendFrom(account, address, amount)
+	return r, c.explain(err)
+}
@@ -35,6 +35,20 @@ type ChainWithMatureOutputsSpawner struct {
 	NodeStartExtraArguments   map[string]interface{}
 	WalletStartExtraArguments map[string]interface{}
 	CreateTempWallet          bool
+
+	// MaxSecondsToWaitOnLaunch limits time to wait for the node and
+	// the wallet to become ready after launch,
+	// DefaultMaxSecondsToWaitOnLaunch when not set
+	MaxSecondsToWaitOnLaunch int
+
+	// KeepWorkingDir, set true to keep harness WorkingDir with the node
+	// and wallet process logs on Dispose. The WorkingDir of a failed
+	// harness is always kept, see Harness.ObserveTest.
+	KeepWorkingDir bool
+
+	// SnapshotCache, when set, keeps data directories of deployed
+	// harnesses and restores them instead of mining the test chain again
+	SnapshotCache *ChainSnapshotCache
 }
 
 // NewInstance does the following:
@@ -103,6 +117,7 @@ func (testSetup *ChainWithMatureOutputsSpawner) NewInstance(harnessName string)
 		Node:       testSetup.NodeFactory.NewNode(nodeConfig),
 		Wallet:     testSetup.WalletFactory.NewWallet(walletConfig),
 		WorkingDir: harnessFolder,
+		ports:      []int{p2p, nodeRPC, walletRPC},
 	}
 
 	pin.AssertTrue("Networks match", harness.Node.Network() == harness.Wallet.Network())
@@ -115,6 +130,7 @@ func (testSetup *ChainWithMatureOutputsSpawner) NewInstance(harnessName string)
 			"Wallet Net<%v> is the same as Node Net<%v>", walletNet, nodeNet),
 		walletNet == nodeNet)
 
+	harness.WatchProcesses()
 	DeploySimpleChain(testSetup, harness)
 
 	return harness
@@ -129,6 +145,16 @@ func (testSetup *ChainWithMatureOutputsSpawner) Dispose(s pin.Spawnable) error {
 	}
 	h.Wallet.Dispose()
 	h.Node.Dispose()
+	for _, port := range h.ports {
+		testSetup.NetPortManager.ReleasePort(port)
+	}
+	if h.Failed() {
+		fmt.Printf("harness %v failed, logs are kept in %v\n", h.Name, h.WorkingDir)
+		return nil
+	}
+	if testSetup.KeepWorkingDir {
+		return nil
+	}
 	return h.DeleteWorkingDir()
 }
 
@@ -0,0 +1,74 @@
+package coinharness
+
+import (
+	"os"
+	"testing"
+)
+
+// failingTest is a test reported failed to its cleanup functions
+type failingTest struct {
+	testing.TB
+	cleanups []func()
+}
+
+func (t *failingTest) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+func (t *failingTest) Failed() bool {
+	return true
+}
+
+func (t *failingTest) finish() {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+}
+
+type disposableNode struct {
+	Node
+}
+
+func (node *disposableNode) Dispose() error {
+	return nil
+}
+
+type disposableWallet struct {
+	Wallet
+}
+
+func (wallet *disposableWallet) Dispose() error {
+	return nil
+}
+
+func TestDisposeKeepsWorkingDirOfFailedHarness(t *testing.T) {
+	spawner := &ChainWithMatureOutputsSpawner{}
+	newHarness := func() *Harness {
+		return &Harness{
+			Name:       "harness",
+			Node:       &disposableNode{},
+			Wallet:     &disposableWallet{},
+			WorkingDir: t.TempDir(),
+		}
+	}
+
+	passed := newHarness()
+	passed.ObserveTest(t)
+	if err := spawner.Dispose(passed); err != nil {
+		t.Fatalf("unable to dispose harness: %v", err)
+	}
+	if _, err := os.Stat(passed.WorkingDir); !os.IsNotExist(err) {
+		t.Fatal("WorkingDir of the passed harness is kept")
+	}
+
+	failed := newHarness()
+	test := &failingTest{TB: t}
+	failed.ObserveTest(test)
+	test.finish()
+	if err := spawner.Dispose(failed); err != nil {
+		t.Fatalf("unable to dispose harness: %v", err)
+	}
+	if _, err := os.Stat(failed.WorkingDir); err != nil {
+		t.Fatalf("WorkingDir of the failed harness is removed: %v", err)
+	}
+}
@@ -1,11 +1,13 @@
 package coinharness
 
 import (
+	"context"
 	"fmt"
 	"github.com/jfixby/pin"
 	"github.com/jfixby/pin/commandline"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // DeploySimpleChain defines harness setup sequence for this package:
@@ -14,16 +16,39 @@ import (
 // 3. builds a new chain with the target number of mature outputs
 // receiving the mining reward to the test wallet
 // 4. syncs wallet to the tip of the chain
+// When the testSetup has the SnapshotCache the harness is restored from
+// the snapshot of the same setup, or the snapshot is saved after deployment.
 func DeploySimpleChain(testSetup *ChainWithMatureOutputsSpawner, h *Harness) {
 	pin.AssertNotEmpty("harness name", h.Name)
+
+	snapshotKey := ""
+	if testSetup.SnapshotCache != nil {
+		// The cache is not used when the executables are not found
+		if setupHash, err := deploymentHash(testSetup, h); err == nil {
+			snapshotKey = testSetup.SnapshotCache.SnapshotKey(
+				testSetup.ActiveNet,
+				ExtractSeedSaltFromHarnessName(h.Name),
+				testSetup.NumMatureOutputs,
+				setupHash,
+			)
+		}
+	}
+	if snapshotKey != "" {
+		if restoreSimpleChain(testSetup, h, snapshotKey) {
+			fmt.Println("Harness[" + h.Name + "] is ready")
+			return
+		}
+	}
+
 	fmt.Println("Deploying Harness[" + h.Name + "]")
 	createFlag := testSetup.CreateTempWallet
 	// launch a fresh h (assumes h working dir is empty)
 	{
 		args := &launchArguments{
-			DebugNodeOutput:    testSetup.DebugNodeOutput,
-			DebugWalletOutput:  testSetup.DebugWalletOutput,
-			NodeExtraArguments: testSetup.NodeStartExtraArguments,
+			DebugNodeOutput:          testSetup.DebugNodeOutput,
+			DebugWalletOutput:        testSetup.DebugWalletOutput,
+			NodeExtraArguments:       testSetup.NodeStartExtraArguments,
+			MaxSecondsToWaitOnLaunch: testSetup.MaxSecondsToWaitOnLaunch,
 		}
 		if createFlag {
 			args.WalletExtraArguments = make(map[string]interface{})
@@ -62,9 +87,10 @@ func DeploySimpleChain(testSetup *ChainWithMatureOutputsSpawner, h *Harness) {
 		shutdownHarnessSequence(h)
 
 		args := &launchArguments{
-			DebugNodeOutput:    testSetup.DebugNodeOutput,
-			DebugWalletOutput:  testSetup.DebugWalletOutput,
-			NodeExtraArguments: testSetup.NodeStartExtraArguments,
+			DebugNodeOutput:          testSetup.DebugNodeOutput,
+			DebugWalletOutput:        testSetup.DebugWalletOutput,
+			NodeExtraArguments:       testSetup.NodeStartExtraArguments,
+			MaxSecondsToWaitOnLaunch: testSetup.MaxSecondsToWaitOnLaunch,
 		}
 		if createFlag {
 			args.WalletExtraArguments = make(map[string]interface{})
@@ -82,54 +108,108 @@ func DeploySimpleChain(testSetup *ChainWithMatureOutputsSpawner, h *Harness) {
 		// wait for the WalletTestServer to sync up to the current height
 		_, H, e := h.NodeRPCClient().GetBestBlock()
 		pin.CheckTestSetupMalfunction(e)
-		h.Wallet.Sync(H)
+		ctx, cancel := context.WithTimeout(context.Background(), WalletSyncTimeout)
+		_, e = h.Wallet.Sync(ctx, H, printSyncProgress)
+		cancel()
+		pin.CheckTestSetupMalfunction(e)
+	}
+	if snapshotKey != "" {
+		saveSimpleChain(testSetup, h, snapshotKey)
 	}
 	fmt.Println("Harness[" + h.Name + "] is ready")
 }
 
+// WalletSyncTimeout limits time the DeploySimpleChain waits for
+// the wallet to sync up to the generated chain
+var WalletSyncTimeout = 5 * time.Minute
+
+// printSyncProgress reports wallet sync progress to console
+func printSyncProgress(syncedHeight int64, desiredHeight int64) {
+	fmt.Println("   sync to: " + strconv.FormatInt(syncedHeight, 10))
+}
+
 // local struct to bundle launchHarnessSequence function arguments
 type launchArguments struct {
-	DebugNodeOutput      bool
-	DebugWalletOutput    bool
-	MiningAddress        Address
-	NodeExtraArguments   map[string]interface{}
-	WalletExtraArguments map[string]interface{}
+	DebugNodeOutput          bool
+	DebugWalletOutput        bool
+	MiningAddress            Address
+	NodeExtraArguments       map[string]interface{}
+	WalletExtraArguments     map[string]interface{}
+	MaxSecondsToWaitOnLaunch int
+}
+
+// relaunchArguments returns arguments to launch the harness with existing
+// data directories, e.g. restored from a snapshot
+func relaunchArguments(testSetup *ChainWithMatureOutputsSpawner) *launchArguments {
+	return &launchArguments{
+		DebugNodeOutput:          testSetup.DebugNodeOutput,
+		DebugWalletOutput:        testSetup.DebugWalletOutput,
+		NodeExtraArguments:       testSetup.NodeStartExtraArguments,
+		MaxSecondsToWaitOnLaunch: testSetup.MaxSecondsToWaitOnLaunch,
+	}
 }
 
 // launchHarnessSequence
 func launchHarnessSequence(h *Harness, args *launchArguments) {
+	err := startHarness(h, args)
+	pin.CheckTestSetupMalfunction(err)
+}
+
+// startHarness starts the harness node and then the wallet
+func startHarness(h *Harness, args *launchArguments) error {
 	node := h.Node
 	wallet := h.Wallet
 
 	sargs := &StartNodeArgs{
-		DebugOutput:    args.DebugNodeOutput,
-		MiningAddress:  h.MiningAddress,
-		ExtraArguments: args.NodeExtraArguments,
+		DebugOutput:              args.DebugNodeOutput,
+		MiningAddress:            h.MiningAddress,
+		ExtraArguments:           args.NodeExtraArguments,
+		MaxSecondsToWaitOnLaunch: args.MaxSecondsToWaitOnLaunch,
+	}
+	err := node.Start(sargs)
+	if err != nil {
+		return err
 	}
-	node.Start(sargs)
 
 	rpcConfig := node.RPCConnectionConfig()
 
 	walletLaunchArguments := &TestWalletStartArgs{
 		NodeRPCCertFile:          node.CertFile(),
 		DebugOutput:              args.DebugWalletOutput,
-		MaxSecondsToWaitOnLaunch: 90,
+		MaxSecondsToWaitOnLaunch: args.MaxSecondsToWaitOnLaunch,
 		NodeRPCConfig:            rpcConfig,
 		ExtraArguments:           args.WalletExtraArguments,
 	}
 
 	// wait for the WalletTestServer to sync up to the current height
-	_, _, e := h.NodeRPCClient().GetBestBlock()
-	pin.CheckTestSetupMalfunction(e)
-
-	wallet.Start(walletLaunchArguments)
+	_, _, err = h.NodeRPCClient().GetBestBlock()
+	if err != nil {
+		return err
+	}
 
+	return wallet.Start(walletLaunchArguments)
 }
 
 // shutdownHarnessSequence reverses the launchHarnessSequence
 func shutdownHarnessSequence(harness *Harness) {
-	harness.Wallet.Stop()
-	harness.Node.Stop()
+	err := stopHarness(harness)
+	pin.CheckTestSetupMalfunction(err)
+}
+
+// restartHarness stops and launches the harness node and wallet again
+func restartHarness(h *Harness, args *launchArguments) error {
+	if err := stopHarness(h); err != nil {
+		return err
+	}
+	return startHarness(h, args)
+}
+
+// stopHarness stops the harness wallet and then the node
+func stopHarness(harness *Harness) error {
+	if err := harness.Wallet.Stop(); err != nil {
+		return err
+	}
+	return harness.Node.Stop()
 }
 
 // ExtractSeedSaltFromHarnessName tries to split harness name string
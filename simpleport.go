@@ -21,3 +21,7 @@ func (man *LazyPortManager) ObtainPort() (result int) {
 	man.offset++
 	return
 }
+
+// ReleasePort does nothing, LazyPortManager never reuses ports
+func (man *LazyPortManager) ReleasePort(port int) {
+}
@@ -0,0 +1,173 @@
+package coinharness
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// Edge is a peer-to-peer connection from the harness
+// with the From index to the harness with the To index
+type Edge struct {
+	From int
+	To   int
+}
+
+// Topology declares peer-to-peer connections between harnesses
+// of a HarnessNetwork
+type Topology interface {
+	// Edges returns connections for the network of n harnesses
+	Edges(n int) []Edge
+}
+
+// LineTopology connects each harness to the next one
+type LineTopology struct {
+}
+
+// Edges implements Topology
+func (topology *LineTopology) Edges(n int) []Edge {
+	edges := []Edge{}
+	for i := 0; i+1 < n; i++ {
+		edges = append(edges, Edge{From: i, To: i + 1})
+	}
+	return edges
+}
+
+// StarTopology connects each harness to the Center one
+type StarTopology struct {
+	Center int
+}
+
+// Edges implements Topology
+func (topology *StarTopology) Edges(n int) []Edge {
+	edges := []Edge{}
+	for i := 0; i < n; i++ {
+		if i != topology.Center {
+			edges = append(edges, Edge{From: i, To: topology.Center})
+		}
+	}
+	return edges
+}
+
+// FullMeshTopology connects each pair of harnesses
+type FullMeshTopology struct {
+}
+
+// Edges implements Topology
+func (topology *FullMeshTopology) Edges(n int) []Edge {
+	edges := []Edge{}
+	for i := 0; i < n; i++ {
+		for j := i + 1; j < n; j++ {
+			edges = append(edges, Edge{From: i, To: j})
+		}
+	}
+	return edges
+}
+
+// CustomTopology connects harnesses with the listed edges
+type CustomTopology []Edge
+
+// Edges implements Topology
+func (topology CustomTopology) Edges(n int) []Edge {
+	return topology
+}
+
+// HarnessNetwork is a set of harnesses spawned together
+// and connected according to a Topology
+type HarnessNetwork struct {
+	Harnesses []*Harness
+	Edges     []Edge
+
+	spawner *ChainWithMatureOutputsSpawner
+}
+
+// HarnessNetworkJoinTimeout limits time the SpawnHarnessNetwork waits
+// for the harnesses to share the same best block
+var HarnessNetworkJoinTimeout = 5 * time.Minute
+
+// SpawnHarnessNetwork spawns a harness for each of the names, connects them
+// according to the topology using the ConnectNode with the addNodeCommand
+// and blocks until all nodes share the same best block and the wallets
+// are synced to it.
+//
+// Only the first harness mines the test chain on deployment, the others
+// start with an empty chain and receive it from their peers. An error is
+// returned when the chains do not converge within HarnessNetworkJoinTimeout.
+func SpawnHarnessNetwork(
+	spawner *ChainWithMatureOutputsSpawner,
+	names []string,
+	topology Topology,
+	addNodeCommand interface{},
+) (*HarnessNetwork, error) {
+	network := &HarnessNetwork{
+		Edges:   topology.Edges(len(names)),
+		spawner: spawner,
+	}
+	for _, edge := range network.Edges {
+		if !network.validIndex(edge.From, len(names)) ||
+			!network.validIndex(edge.To, len(names)) || edge.From == edge.To {
+			return nil, fmt.Errorf("invalid topology edge %v->%v for %v harnesses",
+				edge.From, edge.To, len(names))
+		}
+	}
+
+	followers := *spawner
+	followers.NumMatureOutputs = 0
+	for i, name := range names {
+		instanceSpawner := spawner
+		if i > 0 {
+			instanceSpawner = &followers
+		}
+		harness := instanceSpawner.NewInstance(spawner.NameForTag(name)).(*Harness)
+		network.Harnesses = append(network.Harnesses, harness)
+	}
+
+	for _, edge := range network.Edges {
+		from := network.Harnesses[edge.From]
+		to := network.Harnesses[edge.To]
+		if err := ConnectNode(from, to, addNodeCommand); err != nil {
+			network.Dispose()
+			return nil, fmt.Errorf("unable to connect %v to %v: %v", from.Name, to.Name, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), HarnessNetworkJoinTimeout)
+	defer cancel()
+	for _, joinType := range []JoinType{BestBlockHash, Wallets} {
+		err := JoinNodesContext(ctx, nil, network.Harnesses, joinType, 0)
+		if err != nil {
+			network.Dispose()
+			return nil, fmt.Errorf("harness chains did not converge: %v", err)
+		}
+	}
+	return network, nil
+}
+
+// AssertConnected checks each edge of the network is connected
+func (network *HarnessNetwork) AssertConnected(t *testing.T) {
+	for _, edge := range network.Edges {
+		AssertConnectedTo(t, network.Harnesses[edge.From], network.Harnesses[edge.To])
+	}
+}
+
+// Join blocks until all network nodes are synced according to the joinType
+func (network *HarnessNetwork) Join(command interface{}, joinType JoinType) error {
+	return JoinNodes(command, network.Harnesses, joinType)
+}
+
+// Dispose disposes all network harnesses, returns the last error occurred
+func (network *HarnessNetwork) Dispose() error {
+	var lastErr error
+	for _, harness := range network.Harnesses {
+		if err := network.spawner.Dispose(harness); err != nil {
+			lastErr = err
+		}
+	}
+	network.Harnesses = nil
+	return lastErr
+}
+
+func (network *HarnessNetwork) validIndex(index int, n int) bool {
+	return index >= 0 && index < n
+}
@@ -1,6 +1,7 @@
 package coinharness
 
 import (
+	"context"
 	"fmt"
 	"github.com/jfixby/coin"
 	"github.com/jfixby/pin"
@@ -18,14 +19,16 @@ type Wallet interface {
 	Start(args *TestWalletStartArgs) error
 
 	// Stops wallet process gently
-	Stop()
+	Stop() error
 
 	// Dispose releases all resources allocated by the wallet
 	// This action is final (irreversible)
 	Dispose() error
 
-	// Sync block until the wallet has fully synced up to the desiredHeight
-	Sync(desiredHeight int64) int64
+	// Sync blocks until the wallet has fully synced up to the desiredHeight.
+	// Returns an error when the ctx is done before the desiredHeight
+	// is reached. Progress is reported to the optional onProgress.
+	Sync(ctx context.Context, desiredHeight int64, onProgress SyncProgressFunc) (int64, error)
 
 	SyncedHeight() int64
 
@@ -50,11 +53,23 @@ type Wallet interface {
 	WalletInfo() (*WalletInfoResult, error)
 	ListAccounts() (map[string]coin.Amount, error)
 
-	SendFrom(account string, address Address, amount coin.Amount) error
+	// SendFrom sends amount from the account to the address
+	// and returns hash of the broadcasted transaction
+	SendFrom(account string, address Address, amount coin.Amount) (Hash, error)
 }
 
 const DefaultAccountName = "default"
 
+// SyncProgressFunc receives the wallet height while the wallet
+// syncs up to the desiredHeight
+type SyncProgressFunc func(syncedHeight int64, desiredHeight int64)
+
+// newSyncError reports the wallet failed to reach the desiredHeight
+func newSyncError(ctx context.Context, syncedHeight int64, desiredHeight int64) error {
+	return fmt.Errorf("wallet is synced to %v, desired height %v is not reached: %v",
+		syncedHeight, desiredHeight, ctx.Err())
+}
+
 type WalletInfoResult struct {
 	Unlocked         bool
 	DaemonConnected  bool
@@ -136,6 +151,15 @@ type CreateTransactionArgs struct {
 	PayToAddrScript func(Address) ([]byte, error) // txscript.PayToAddrScript(addr)
 	TxSerializeSize func(*MessageTx) int          // *wire.MsgTx.TxSerializeSize()
 	Account         string
+
+	// CoinSelector picks outputs to fund the transaction,
+	// FirstFitCoinSelector is used when not set
+	CoinSelector CoinSelector
+
+	// NewHashFromStr parses Unspent.TxID, the result must be
+	// comparable with the MessageTx.TxHash() values. When not set, a wallet
+	// implementing TxIDParser parses it, otherwise NewHashFromStr is used.
+	NewHashFromStr func(string) (Hash, error) // chainhash.NewHashFromStr(txid)
 }
 
 // TestWalletStartArgs bundles Start() arguments to minimize diff
@@ -152,7 +176,43 @@ type TestWalletStartArgs struct {
 // outputs while observing the desired fee rate. The passed fee rate should be
 // expressed in satoshis-per-byte. The transaction being created can optionally
 // include a change output indicated by the Change boolean.
+//
+// When the wallet implements OutputsLocker, the selected outputs stay locked
+// until released with the UnlockOutputs.
 func CreateTransaction(wallet Wallet, args *CreateTransactionArgs) (*MessageTx, error) {
+	// The change address is allocated once for all of the attempts
+	var changeAddr Address
+	changeAddress := func() (Address, error) {
+		if changeAddr == nil {
+			addr, err := wallet.GetNewAddress(args.Account)
+			if err != nil {
+				return nil, err
+			}
+			changeAddr = addr
+		}
+		return changeAddr, nil
+	}
+
+	for attempt := 0; ; attempt++ {
+		tx, err := createTransaction(wallet, args, changeAddress)
+		// A concurrent call has locked some of the selected outputs,
+		// select again from the remaining ones.
+		if err == ErrOutputsLocked && attempt < maxCoinSelectionAttempts {
+			continue
+		}
+		return tx, err
+	}
+}
+
+// DefaultFeeRate is the fee rate in atoms-per-byte used by the
+// InMemoryWallet.SendFrom when the wallet FeeRate is not set
+var DefaultFeeRate = coin.Amount{AtomsValue: 10}
+
+// maxCoinSelectionAttempts limits CreateTransaction retries caused by
+// concurrent calls competing for the same outputs
+const maxCoinSelectionAttempts = 10
+
+func createTransaction(wallet Wallet, args *CreateTransactionArgs, changeAddress func() (Address, error)) (*MessageTx, error) {
 	unspent, err := wallet.ListUnspent()
 	if err != nil {
 		return nil, err
@@ -162,45 +222,143 @@ func CreateTransaction(wallet Wallet, args *CreateTransactionArgs) (*MessageTx,
 
 	// Tally up the total amount to be sent in order to perform coin
 	// selection shortly below.
-	outputAmt := coin.Amount{0}
+	outputAmt := coin.Amount{AtomsValue: 0}
 	for _, output := range args.Outputs {
 		outputAmt.AtomsValue += output.Value.AtomsValue
 		tx.TxOut = append(tx.TxOut, output)
 	}
 
+	parseTxID := args.NewHashFromStr
+	if parseTxID == nil {
+		parseTxID = NewHashFromStr
+		if parser, ok := wallet.(TxIDParser); ok {
+			parseTxID = parser.ParseTxID
+		}
+	}
+
 	// Attempt to fund the transaction with spendable Utxos.
-	if err := fundTx(
-		wallet,
+	selected, err := fundTx(
+		changeAddress,
 		args.Account,
 		unspent,
 		tx,
 		outputAmt,
 		args.FeeRate,
+		args.CoinSelector,
 		args.PayToAddrScript,
 		args.TxSerializeSize,
-	); err != nil {
+		parseTxID,
+	)
+	if err != nil {
 		return nil, err
 	}
 
+	// Reserve the selected outputs so they are not picked
+	// by another transaction.
+	locker, isLocker := wallet.(OutputsLocker)
+	if isLocker {
+		if err := locker.LockOutputs(txInputs(tx)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Sign the inputs when the wallet is able to do so locally,
+	// otherwise the transaction is returned unsigned.
+	if signer, ok := wallet.(TxSigner); ok {
+		if err := signer.SignTx(tx, selected); err != nil {
+			if isLocker {
+				locker.UnlockOutputs(txInputs(tx))
+			}
+			return nil, err
+		}
+	}
+
 	return tx, nil
 }
 
+// txInputs lists inputs of the tx
+func txInputs(tx *MessageTx) []TxIn {
+	inputs := make([]TxIn, 0, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		inputs = append(inputs, *in)
+	}
+	return inputs
+}
+
+// ErrOutputsLocked is returned by the OutputsLocker.LockOutputs
+// when an output is already locked
+var ErrOutputsLocked = fmt.Errorf("output is already locked")
+
+// OutputsLocker is implemented by wallets which keep track of
+// the outputs reserved by CreateTransaction.
+type OutputsLocker interface {
+	// LockOutputs locks outputs spent by the inputs, it locks
+	// nothing and returns ErrOutputsLocked when any of them
+	// is already locked
+	LockOutputs(inputs []TxIn) error
+
+	// UnlockOutputs releases outputs spent by the inputs
+	UnlockOutputs(inputs []TxIn) error
+}
+
+// TxIDParser is implemented by wallets able to parse Unspent.TxID
+// into the chain-specific Hash.
+type TxIDParser interface {
+	// ParseTxID parses the Unspent.TxID, the result must be
+	// comparable with the MessageTx.TxHash() values
+	ParseTxID(txID string) (Hash, error)
+}
+
+// StringHash is a Hash keeping the hash in the byte-reversed hex form
+type StringHash string
+
+// String implements Hash
+func (h StringHash) String() string {
+	return string(h)
+}
+
+// NewHashFromStr parses the hash string into StringHash,
+// which does not depend on the chain-specific hash type
+func NewHashFromStr(s string) (Hash, error) {
+	if s == "" {
+		return nil, fmt.Errorf("hash string is empty")
+	}
+	return StringHash(s), nil
+}
+
+// TxSigner is implemented by wallets able to sign transactions
+// produced by CreateTransaction without a wallet RPC server.
+type TxSigner interface {
+	// SignTx fills the SignatureScript of each tx input,
+	// spent[i] is the output spent by the tx.TxIn[i]
+	SignTx(tx *MessageTx, spent []*Unspent) error
+}
+
+// Rescanner is implemented by wallets able to rebuild their state
+// from the node chain
+type Rescanner interface {
+	// Rescan feeds the wallet with the node blocks from the fromHeight
+	// to the toHeight, returns when the blocks are applied
+	Rescan(fromHeight int64, toHeight int64) error
+}
+
 // fundTx attempts to fund a transaction sending amt coins.  The coins are
-// selected such that the final amount spent pays enough fees as dictated by
-// the passed fee rate.  The passed fee rate should be expressed in
-// atoms-per-byte.
-//
-// NOTE: The InMemoryWallet's mutex must be held when this function is called.
+// selected by the selector such that the final amount spent pays enough fees
+// as dictated by the passed fee rate.  The passed fee rate should be
+// expressed in atoms-per-byte. Returns the outputs selected to fund the
+// transaction in the order of the transaction inputs.
 func fundTx(
-	wallet Wallet,
+	changeAddress func() (Address, error),
 	account string,
 	unspent []*Unspent,
 	tx *MessageTx,
 	amt coin.Amount,
 	feeRate coin.Amount,
+	selector CoinSelector,
 	PayToAddrScript func(Address) ([]byte, error),
 	TxSerializeSize func(*MessageTx) int,
-) error {
+	NewHashFromStr func(string) (Hash, error),
+) ([]*Unspent, error) {
 	const (
 		// spendSize is the largest number of bytes of a sigScript
 		// which spends a p2pkh output: OP_DATA_73 <sig> OP_DATA_33 <pubkey>
@@ -211,8 +369,11 @@ func fundTx(
 	pin.AssertNotNil("TxSerializeSize", TxSerializeSize)
 	pin.AssertNotEmpty("account", account)
 
-	amtSelected := coin.Amount{0}
-	//txSize := int64(0)
+	if selector == nil {
+		selector = &FirstFitCoinSelector{}
+	}
+
+	candidates := []*Unspent{}
 	for _, output := range unspent {
 		// Skip any outputs that are still currently immature or are
 		// currently locked.
@@ -222,54 +383,76 @@ func fundTx(
 		if output.Account != account {
 			continue
 		}
+		candidates = append(candidates, output)
+	}
+
+	// Calculate the fee required for the txn spending numInputs
+	// observing the specified fee rate, accounting for the size
+	// of the future sigScripts.
+	requiredFee := func(numInputs int) coin.Amount {
+		draft := *tx
+		draft.TxIn = make([]*TxIn, numInputs)
+		for i := range draft.TxIn {
+			draft.TxIn[i] = &TxIn{}
+		}
+		txSize := TxSerializeSize(&draft) + spendSize*numInputs
+		return coin.Amount{AtomsValue: int64(txSize) * feeRate.AtomsValue}
+	}
+	amountNeeded := func(numInputs int) coin.Amount {
+		return coin.Amount{AtomsValue: amt.AtomsValue + requiredFee(numInputs).AtomsValue}
+	}
+
+	selection, err := selector.SelectCoins(candidates, amountNeeded)
+	if err != nil {
+		return nil, err
+	}
+
+	amtSelected := coin.Amount{AtomsValue: 0}
+	for _, output := range selection.Inputs {
+		txHash, err := NewHashFromStr(output.TxID)
+		if err != nil {
+			return nil, err
+		}
 
 		amtSelected.AtomsValue += output.Amount.AtomsValue
 
-		// Add the selected output to the transaction, updating the
-		// current tx size while accounting for the size of the future
-		// sigScript.
+		// Add the selected output to the transaction.
 		txIn := &TxIn{
 			PreviousOutPoint: OutPoint{
-				Tree: output.Tree,
+				Hash:  txHash,
+				Index: output.Vout,
+				Tree:  output.Tree,
 			},
 			ValueIn: output.Amount.Copy(),
 		}
 		tx.TxIn = append(tx.TxIn, txIn)
+	}
 
-		txSize := TxSerializeSize(tx) + spendSize*len(tx.TxIn)
+	// If we don't have enough coins from the amount selected to pay
+	// the fee, then coin selection failed.
+	reqFee := requiredFee(len(tx.TxIn))
+	collected := amtSelected.AtomsValue - reqFee.AtomsValue
+	if collected < amt.AtomsValue {
+		return nil, fmt.Errorf("not enough funds for coin selection")
+	}
 
-		// Calculate the fee required for the txn at this point
-		// observing the specified fee rate. If we don't have enough
-		// coins from he current amount selected to pay the fee, then
-		// continue to grab more coins.
-		reqFee := coin.Amount{int64(txSize) * feeRate.AtomsValue}
-		collected := amtSelected.AtomsValue - reqFee.AtomsValue
-		if collected < amt.AtomsValue {
-			continue
+	// If we have any change left over, then add an additional
+	// output to the transaction reserved for change.
+	changeVal := coin.Amount{AtomsValue: amtSelected.AtomsValue - amt.AtomsValue - reqFee.AtomsValue}
+	if changeVal.AtomsValue > 0 && !selection.NoChange {
+		addr, err := changeAddress()
+		if err != nil {
+			return nil, err
 		}
-
-		// If we have any change left over, then add an additional
-		// output to the transaction reserved for change.
-		changeVal := coin.Amount{amtSelected.AtomsValue - amt.AtomsValue - reqFee.AtomsValue}
-		if changeVal.AtomsValue > 0 {
-			addr, err := wallet.GetNewAddress(account)
-			if err != nil {
-				return err
-			}
-			pkScript, err := PayToAddrScript(addr)
-			if err != nil {
-				return err
-			}
-			changeOutput := &TxOut{
-				Value:    changeVal,
-				PkScript: pkScript,
-			}
-			tx.TxOut = append(tx.TxOut, changeOutput)
+		pkScript, err := PayToAddrScript(addr)
+		if err != nil {
+			return nil, err
 		}
-		return nil
+		changeOutput := &TxOut{
+			Value:    changeVal,
+			PkScript: pkScript,
+		}
+		tx.TxOut = append(tx.TxOut, changeOutput)
 	}
-
-	// If we've reached this point, then coin selection failed due to an
-	// insufficient amount of coins.
-	return fmt.Errorf("not enough funds for coin selection")
+	return selection.Inputs, nil
 }
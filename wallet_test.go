@@ -0,0 +1,148 @@
+package coinharness
+
+import (
+	"github.com/jfixby/coin"
+	"testing"
+)
+
+// fakeWallet lists the unspent outputs and issues change addresses
+type fakeWallet struct {
+	Wallet
+	unspent []*Unspent
+}
+
+func (w *fakeWallet) ListUnspent() ([]*Unspent, error) {
+	return w.unspent, nil
+}
+
+func (w *fakeWallet) GetNewAddress(accountName string) (Address, error) {
+	return testAddress("change"), nil
+}
+
+func newTestTxArgs(feeRate coin.Amount, outputs ...int64) *CreateTransactionArgs {
+	args := &CreateTransactionArgs{
+		FeeRate:         feeRate,
+		Account:         DefaultAccountName,
+		PayToAddrScript: func(addr Address) ([]byte, error) { return addr.ScriptAddress(), nil },
+		TxSerializeSize: func(*MessageTx) int { return 100 },
+		NewHashFromStr:  func(s string) (Hash, error) { return testHash(s), nil },
+	}
+	for _, value := range outputs {
+		args.Outputs = append(args.Outputs, &TxOut{Value: coin.Amount{AtomsValue: value}})
+	}
+	return args
+}
+
+func TestCreateTransactionZeroFeeRate(t *testing.T) {
+	wallet := &fakeWallet{unspent: []*Unspent{{
+		TxID:      "funding",
+		Account:   DefaultAccountName,
+		Amount:    coin.Amount{AtomsValue: 1000000},
+		Spendable: true,
+	}}}
+
+	tx, err := CreateTransaction(wallet, newTestTxArgs(coin.Amount{}, 500000))
+	if err != nil {
+		t.Fatalf("unable to create transaction: %v", err)
+	}
+	if len(tx.TxOut) != 2 {
+		t.Fatalf("expected the payment and the change outputs, got %v", len(tx.TxOut))
+	}
+	fee := int64(1000000) - tx.TxOut[0].Value.AtomsValue - tx.TxOut[1].Value.AtomsValue
+	if fee != 0 {
+		t.Fatalf("fee %v, expected no fee", fee)
+	}
+}
+
+func TestSendFromDefaultFeeRate(t *testing.T) {
+	wallet := &InMemoryWallet{
+		PayToAddrScript: func(addr Address) ([]byte, error) { return addr.ScriptAddress(), nil },
+	}
+	args, err := wallet.sendFromArgs(DefaultAccountName, testAddress("payee"), coin.Amount{AtomsValue: 1000})
+	if err != nil {
+		t.Fatalf("unable to prepare transaction: %v", err)
+	}
+	if args.FeeRate.AtomsValue != DefaultFeeRate.AtomsValue {
+		t.Fatalf("fee rate %v, expected %v", args.FeeRate, DefaultFeeRate)
+	}
+
+	wallet.FeeRate = coin.Amount{AtomsValue: 3}
+	args, err = wallet.sendFromArgs(DefaultAccountName, testAddress("payee"), coin.Amount{AtomsValue: 1000})
+	if err != nil {
+		t.Fatalf("unable to prepare transaction: %v", err)
+	}
+	if args.FeeRate.AtomsValue != wallet.FeeRate.AtomsValue {
+		t.Fatalf("fee rate %v, expected the wallet fee rate %v", args.FeeRate, wallet.FeeRate)
+	}
+}
+
+func TestCreateTransactionDefaultHashParser(t *testing.T) {
+	wallet := &fakeWallet{unspent: []*Unspent{{
+		TxID:      "funding",
+		Vout:      1,
+		Account:   DefaultAccountName,
+		Amount:    coin.Amount{AtomsValue: 1000000},
+		Spendable: true,
+	}}}
+
+	args := newTestTxArgs(coin.Amount{AtomsValue: 1}, 500000)
+	args.NewHashFromStr = nil
+	tx, err := CreateTransaction(wallet, args)
+	if err != nil {
+		t.Fatalf("unable to create transaction: %v", err)
+	}
+	expected := OutPoint{Hash: StringHash("funding"), Index: 1}
+	if len(tx.TxIn) != 1 || tx.TxIn[0].PreviousOutPoint != expected {
+		t.Fatalf("inputs %v, expected to spend %v", tx.TxIn, expected)
+	}
+}
+
+// contendedWallet loses the selected outputs to a concurrent
+// transaction on the first attempts
+type contendedWallet struct {
+	fakeWallet
+	lockFailures int
+	newAddresses int
+	lockedInputs []TxIn
+}
+
+func (w *contendedWallet) GetNewAddress(accountName string) (Address, error) {
+	w.newAddresses++
+	return w.fakeWallet.GetNewAddress(accountName)
+}
+
+func (w *contendedWallet) LockOutputs(inputs []TxIn) error {
+	if w.lockFailures > 0 {
+		w.lockFailures--
+		return ErrOutputsLocked
+	}
+	w.lockedInputs = inputs
+	return nil
+}
+
+func (w *contendedWallet) UnlockOutputs(inputs []TxIn) error {
+	return nil
+}
+
+func TestCreateTransactionAllocatesChangeAddressOnce(t *testing.T) {
+	wallet := &contendedWallet{
+		fakeWallet: fakeWallet{unspent: []*Unspent{{
+			TxID:      "funding",
+			Account:   DefaultAccountName,
+			Amount:    coin.Amount{AtomsValue: 1000000},
+			Spendable: true,
+		}}},
+		lockFailures: 3,
+	}
+
+	tx, err := CreateTransaction(wallet, newTestTxArgs(coin.Amount{AtomsValue: 1}, 500000))
+	if err != nil {
+		t.Fatalf("unable to create transaction: %v", err)
+	}
+	if len(tx.TxOut) != 2 || len(wallet.lockedInputs) != 1 {
+		t.Fatalf("expected a funded transaction with change, got %v outputs", len(tx.TxOut))
+	}
+	if wallet.newAddresses != 1 {
+		t.Fatalf("%v change addresses allocated, expected 1", wallet.newAddresses)
+	}
+}